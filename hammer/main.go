@@ -17,7 +17,7 @@ const NRELEASES int = 100
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	prscrape.ServerMain("hammer.db", configure)
+	prscrape.ServerMain("hammer.db", "", configure)
 }
 
 func configure(historical bool) []*prscrape.Scraper {
@@ -49,8 +49,8 @@ func NewHammerScraper(sourcenum int) *prscrape.Scraper {
 		return out, nil
 	}
 	s := prscrape.Scraper{
-		name,
-		hammer,
-		nil}
+		Name:     name,
+		Discover: hammer,
+	}
 	return &s
 }
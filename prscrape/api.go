@@ -0,0 +1,403 @@
+package prscrape
+
+// JSON api for querying the stored press releases, for clients which
+// don't want to hold a stream open.
+//
+//   /api/sources
+//     list of sources, with the number of stored press releases for each
+//
+//   /api/releases?source=&since=&until=&limit=&cursor=
+//     press releases, in id order. since/until filter on publication date
+//     (YYYY-MM-DD or RFC3339). cursor is an id to continue from (as per
+//     Last-Event-ID). The response includes a next_cursor to fetch the
+//     next batch with, if there might be more.
+//
+//   /api/releases/<id>
+//     a single press release (same json as in the event stream)
+//
+//   /api/releases/<id>/revisions
+//     earlier versions of a press release, oldest first (see revisions.go)
+//
+//   /api/releases/<id>/raw
+//     the page the press release was scraped from, as it was served
+//     (?format=json gives the url, status, headers and fetch time instead)
+//
+//   /api/search?q=&source=&since=&until=&limit=
+//     full-text search, best matches first. q is an FTS5 query
+//     (eg: tesco AND "horse meat"). source can be given multiple times.
+//
+//
+// Quarantined press releases are managed through the admin listener (see
+// -adminaddr), as they can be changed and sent out to clients:
+//
+//   /admin/quarantine?source=&discarded=
+//     press releases which failed validation (discarded ones are only
+//     included if discarded=1)
+//
+//   /admin/quarantine/<id>
+//     a single quarantined press release. PUT (or POST) a press release
+//     to fix it up - fields left out are unchanged.
+//
+//   /admin/quarantine/<id>/raw
+//     the page the quarantined press release was scraped from (as for
+//     /api/releases/<id>/raw)
+//
+//   /admin/quarantine/<id>/release?force= (POST)
+//     move into the store proper, and send out to clients. If it still
+//     has problems, it's refused (409) unless force=1.
+//
+//   /admin/quarantine/<id>/discard (POST)
+//     mark as unwanted
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donovanhide/eventsource"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+type api struct {
+	store    *DBStore
+	scrapers *scraperSet
+	sseSrv   *eventsource.Server
+}
+
+// apiRelease is a press release as returned in lists
+type apiRelease struct {
+	ID   int             `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+func newAPIRelease(ev *pressReleaseEvent) *apiRelease {
+	return &apiRelease{ev.id, json.RawMessage(ev.Data())}
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api"), "/")
+	switch {
+	case path == "sources":
+		a.sources(w, req)
+	case path == "search":
+		a.search(w, req)
+	case path == "releases":
+		a.releases(w, req)
+	case strings.HasPrefix(path, "releases/"):
+		parts := strings.Split(strings.TrimPrefix(path, "releases/"), "/")
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) > 2 {
+			http.NotFound(w, req)
+			return
+		}
+		if len(parts) == 1 {
+			a.release(w, req, id)
+			return
+		}
+		switch parts[1] {
+		case "revisions":
+			a.revisions(w, req, id)
+		case "raw":
+			a.raw(w, req, id)
+		default:
+			http.NotFound(w, req)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// quarantineAPI serves /admin/quarantine (on the admin listener only)
+type quarantineAPI struct {
+	*api
+}
+
+func (a quarantineAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin"), "/")
+	switch {
+	case path == "quarantine":
+		a.quarantineList(w, req)
+	case strings.HasPrefix(path, "quarantine/"):
+		parts := strings.Split(strings.TrimPrefix(path, "quarantine/"), "/")
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) > 2 {
+			http.NotFound(w, req)
+			return
+		}
+		action := ""
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		a.quarantine(w, req, id, action)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (a *api) sources(w http.ResponseWriter, req *http.Request) {
+	counts, err := a.store.SourceCounts()
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	type sourceInfo struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	sources := []sourceInfo{}
+	for _, name := range a.scrapers.Names() {
+		sources = append(sources, sourceInfo{name, counts[name]})
+	}
+	a.write(w, sources)
+}
+
+func (a *api) releases(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	q := &ReleaseQuery{Source: params.Get("source"), Limit: apiDefaultLimit}
+	if bad := parseCommonParams(params, &q.Since, &q.Until, &q.Limit); bad != "" {
+		http.Error(w, "bad "+bad, http.StatusBadRequest)
+		return
+	}
+	if s := params.Get("cursor"); s != "" {
+		var err error
+		if q.After, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	evs, err := a.store.Query(q)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	out := struct {
+		Releases   []*apiRelease `json:"releases"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{Releases: make([]*apiRelease, len(evs))}
+	for i, ev := range evs {
+		out.Releases[i] = newAPIRelease(ev)
+	}
+	if len(evs) == q.Limit {
+		out.NextCursor = evs[len(evs)-1].Id()
+	}
+	a.write(w, out)
+}
+
+func (a *api) search(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	q := &SearchQuery{Text: params.Get("q"), Sources: params["source"], Limit: apiDefaultLimit}
+	if q.Text == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+	if bad := parseCommonParams(params, &q.Since, &q.Until, &q.Limit); bad != "" {
+		http.Error(w, "bad "+bad, http.StatusBadRequest)
+		return
+	}
+
+	hits, err := a.store.Search(q)
+	if err == ErrNoSearch {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		// most likely a malformed query
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type apiHit struct {
+		ID      int             `json:"id"`
+		Score   float64         `json:"score"`
+		Snippet string          `json:"snippet"`
+		Data    json.RawMessage `json:"data"`
+	}
+	out := struct {
+		Hits []*apiHit `json:"hits"`
+	}{make([]*apiHit, len(hits))}
+	for i, hit := range hits {
+		ev := &pressReleaseEvent{hit.Release, hit.ID}
+		out.Hits[i] = &apiHit{hit.ID, hit.Score, hit.Snippet, json.RawMessage(ev.Data())}
+	}
+	a.write(w, out)
+}
+
+func (a *api) release(w http.ResponseWriter, req *http.Request, id int) {
+	ev, err := a.store.Fetch(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if ev == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ev.Data())
+}
+
+func (a *api) revisions(w http.ResponseWriter, req *http.Request, id int) {
+	ev, err := a.store.Fetch(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if ev == nil {
+		http.NotFound(w, req)
+		return
+	}
+	revs, err := a.store.Revisions(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.write(w, revs)
+}
+
+func (a *api) raw(w http.ResponseWriter, req *http.Request, id int) {
+	raw, err := a.store.Raw(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if raw == nil {
+		http.NotFound(w, req)
+		return
+	}
+	serveRaw(w, req, raw)
+}
+
+func (a *api) quarantineRaw(w http.ResponseWriter, req *http.Request, id int) {
+	raw, err := a.store.QuarantineRaw(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if raw == nil {
+		http.NotFound(w, req)
+		return
+	}
+	serveRaw(w, req, raw)
+}
+
+func (a *api) quarantineList(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	qs, err := a.store.QuarantineList(params.Get("source"), params.Get("discarded") == "1")
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.write(w, qs)
+}
+
+func (a *api) quarantine(w http.ResponseWriter, req *http.Request, id int, action string) {
+	if action == "raw" {
+		a.quarantineRaw(w, req, id)
+		return
+	}
+	if action != "" && req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := a.store.QuarantineGet(id)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch action {
+	case "":
+		if req.Method == "PUT" || req.Method == "POST" {
+			if err := q.fix(req.Body, validationFor(a.scrapers.Get(q.Release.Source))); err != nil {
+				http.Error(w, "bad press release: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := a.store.QuarantineUpdate(id, q.Release, q.Problems); err != nil {
+				a.fail(w, err)
+				return
+			}
+		}
+		a.write(w, q)
+	case "release":
+		ev, err := a.store.QuarantineRelease(id, req.URL.Query().Get("force") == "1")
+		if err == errStillProblems {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+		if a.sseSrv != nil {
+			a.sseSrv.Publish([]string{ev.payload.Source}, ev)
+			metricEventsPublished.Inc(ev.payload.Source)
+		}
+		a.write(w, newAPIRelease(ev))
+	case "discard":
+		if err := a.store.QuarantineDiscard(id); err != nil {
+			a.fail(w, err)
+			return
+		}
+		q.Discarded = true
+		a.write(w, q)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// parseCommonParams handles the since, until and limit params.
+// Returns the name of the first bad param, or "" if all ok.
+func parseCommonParams(params url.Values, since, until *time.Time, limit *int) string {
+	var err error
+	if s := params.Get("since"); s != "" {
+		if *since, err = parseAPITime(s); err != nil {
+			return "since"
+		}
+	}
+	if s := params.Get("until"); s != "" {
+		if *until, err = parseAPITime(s); err != nil {
+			return "until"
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		if *limit, err = strconv.Atoi(s); err != nil || *limit < 1 {
+			return "limit"
+		}
+		if *limit > apiMaxLimit {
+			*limit = apiMaxLimit
+		}
+	}
+	return ""
+}
+
+// parseAPITime accepts either a date or a full RFC3339 timestamp
+func parseAPITime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (a *api) write(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		glog.Errorf("api: %s", err)
+	}
+}
+
+func (a *api) fail(w http.ResponseWriter, err error) {
+	glog.Errorf("api: %s", err)
+	http.Error(w, "Internal error", http.StatusInternalServerError)
+}
@@ -0,0 +1,78 @@
+package prscrape
+
+import (
+	"time"
+)
+
+// BreakerThreshold is the number of consecutive failed runs after which a
+// scraper's circuit breaker opens
+var BreakerThreshold = 3
+
+// BreakerCooldown is how long a scraper is left alone after its breaker
+// opens. It doubles each time a trial run fails, up to BreakerMaxCooldown.
+var BreakerCooldown = 30 * time.Minute
+var BreakerMaxCooldown = 24 * time.Hour
+
+// circuit breaker states
+const (
+	breakerClosed   = "closed"    // all ok - run as normal
+	breakerOpen     = "open"      // failing - don't run until cooldown is up
+	breakerHalfOpen = "half-open" // trial run after cooldown
+)
+
+// breaker stops us hammering away at a source which is persistently
+// failing (site down, layout changed, whatever).
+type breaker struct {
+	state     string
+	failures  int // consecutive
+	lastError string
+	cooldown  time.Duration
+	until     time.Time // when an open breaker allows a trial run
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: breakerClosed}
+}
+
+// allow is called before a run. If it's time for a trial run, an open
+// breaker becomes half-open.
+func (b *breaker) allow(now time.Time) bool {
+	if b.state == breakerOpen {
+		if now.Before(b.until) {
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+// record notes the outcome of a run.
+// Returns true if the state changed.
+func (b *breaker) record(err error, now time.Time) bool {
+	prev := b.state
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		b.lastError = ""
+		b.cooldown = 0
+		return b.state != prev
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	switch {
+	case b.state == breakerHalfOpen:
+		// trial failed - back off for longer
+		b.cooldown *= 2
+		if b.cooldown > BreakerMaxCooldown {
+			b.cooldown = BreakerMaxCooldown
+		}
+	case b.failures >= BreakerThreshold:
+		b.cooldown = BreakerCooldown
+	default:
+		return false
+	}
+	b.state = breakerOpen
+	b.until = now.Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,103 @@
+package prscrape
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	fail := errors.New("boom")
+	start := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// each step is either a run being allowed (or not), or the outcome
+	// of a run
+	type step struct {
+		allow   bool // a call to allow() rather than record()
+		err     error
+		now     time.Time
+		want    bool // allowed, or state changed
+		state   string
+		failing int
+		until   time.Time
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after threshold", []step{
+			{allow: true, now: at(0), want: true, state: breakerClosed},
+			{err: fail, now: at(0), want: false, state: breakerClosed, failing: 1},
+			{err: fail, now: at(1 * time.Minute), want: false, state: breakerClosed, failing: 2},
+			{err: fail, now: at(2 * time.Minute), want: true, state: breakerOpen, failing: 3, until: at(32 * time.Minute)},
+			{allow: true, now: at(31 * time.Minute), want: false, state: breakerOpen, failing: 3, until: at(32 * time.Minute)},
+			{allow: true, now: at(32 * time.Minute), want: true, state: breakerHalfOpen, failing: 3, until: at(32 * time.Minute)},
+		}},
+		{"success resets the count", []step{
+			{err: fail, now: at(0), want: false, state: breakerClosed, failing: 1},
+			{err: fail, now: at(0), want: false, state: breakerClosed, failing: 2},
+			{err: nil, now: at(0), want: false, state: breakerClosed},
+			{err: fail, now: at(0), want: false, state: breakerClosed, failing: 1},
+		}},
+		{"failed trials double the cooldown, up to the max", []step{
+			{err: fail, now: at(0), state: breakerClosed, failing: 1},
+			{err: fail, now: at(0), state: breakerClosed, failing: 2},
+			{err: fail, now: at(0), want: true, state: breakerOpen, failing: 3, until: at(30 * time.Minute)},
+			{allow: true, now: at(30 * time.Minute), want: true, state: breakerHalfOpen, failing: 3, until: at(30 * time.Minute)},
+			{err: fail, now: at(30 * time.Minute), want: true, state: breakerOpen, failing: 4, until: at(90 * time.Minute)},
+			{allow: true, now: at(90 * time.Minute), want: true, state: breakerHalfOpen, failing: 4, until: at(90 * time.Minute)},
+			{err: fail, now: at(90 * time.Minute), want: true, state: breakerOpen, failing: 5, until: at(210 * time.Minute)},
+			// 4h, 8h, 16h, then capped at 24h
+			{allow: true, now: at(100 * time.Hour), want: true, state: breakerHalfOpen, failing: 5, until: at(210 * time.Minute)},
+			{err: fail, now: at(100 * time.Hour), want: true, state: breakerOpen, failing: 6, until: at(104 * time.Hour)},
+			{allow: true, now: at(104 * time.Hour), want: true, state: breakerHalfOpen, failing: 6, until: at(104 * time.Hour)},
+			{err: fail, now: at(104 * time.Hour), want: true, state: breakerOpen, failing: 7, until: at(112 * time.Hour)},
+			{allow: true, now: at(112 * time.Hour), want: true, state: breakerHalfOpen, failing: 7, until: at(112 * time.Hour)},
+			{err: fail, now: at(112 * time.Hour), want: true, state: breakerOpen, failing: 8, until: at(128 * time.Hour)},
+			{allow: true, now: at(128 * time.Hour), want: true, state: breakerHalfOpen, failing: 8, until: at(128 * time.Hour)},
+			{err: fail, now: at(128 * time.Hour), want: true, state: breakerOpen, failing: 9, until: at(152 * time.Hour)},
+			{allow: true, now: at(152 * time.Hour), want: true, state: breakerHalfOpen, failing: 9, until: at(152 * time.Hour)},
+			{err: fail, now: at(152 * time.Hour), want: true, state: breakerOpen, failing: 10, until: at(176 * time.Hour)},
+		}},
+		{"successful trial closes it", []step{
+			{err: fail, now: at(0), state: breakerClosed, failing: 1},
+			{err: fail, now: at(0), state: breakerClosed, failing: 2},
+			{err: fail, now: at(0), want: true, state: breakerOpen, failing: 3, until: at(30 * time.Minute)},
+			{allow: true, now: at(30 * time.Minute), want: true, state: breakerHalfOpen, failing: 3, until: at(30 * time.Minute)},
+			{err: nil, now: at(30 * time.Minute), want: true, state: breakerClosed, until: at(30 * time.Minute)},
+			// back to square one
+			{err: fail, now: at(31 * time.Minute), state: breakerClosed, failing: 1, until: at(30 * time.Minute)},
+			{err: fail, now: at(31 * time.Minute), state: breakerClosed, failing: 2, until: at(30 * time.Minute)},
+			{err: fail, now: at(31 * time.Minute), want: true, state: breakerOpen, failing: 3, until: at(61 * time.Minute)},
+		}},
+	}
+	for _, test := range tests {
+		b := newBreaker()
+		for i, s := range test.steps {
+			var got bool
+			if s.allow {
+				got = b.allow(s.now)
+			} else {
+				got = b.record(s.err, s.now)
+			}
+			if got != s.want || b.state != s.state || b.failures != s.failing || !b.until.Equal(s.until) {
+				t.Errorf("%s, step %d: got %t %s %d %s, expected %t %s %d %s", test.name, i,
+					got, b.state, b.failures, b.until, s.want, s.state, s.failing, s.until)
+				break
+			}
+		}
+	}
+}
+
+func TestBreakerLastError(t *testing.T) {
+	b := newBreaker()
+	b.record(errors.New("boom"), time.Now())
+	if b.lastError != "boom" {
+		t.Errorf("got lastError %q, expected \"boom\"", b.lastError)
+	}
+	b.record(nil, time.Now())
+	if b.lastError != "" {
+		t.Errorf("expected lastError to be cleared, got %q", b.lastError)
+	}
+}
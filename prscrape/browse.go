@@ -0,0 +1,168 @@
+package prscrape
+
+// A simple html interface for browsing through the stored press releases,
+// for visual sanity-checking of scraper output.
+//
+//   /browse/                 - list of sources
+//   /browse/<source>/        - recent press releases from source
+//   /browse/<source>/<id>    - a single press release
+
+import (
+	"github.com/golang/glog"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// how many press releases to list per source
+const browseLimit = 100
+
+type browser struct {
+	store    *DBStore
+	scrapers *scraperSet
+}
+
+var browseTmpls = template.Must(template.New("browse").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - ukpr</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.meta { color: #666; }
+.content { white-space: pre-wrap; max-width: 50em; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "foot"}}</body>
+</html>
+{{end}}
+
+{{define "sources"}}{{template "head" "sources"}}
+<h1>Sources</h1>
+<table>
+<tr><th>source</th><th>stored</th></tr>
+{{range .}}<tr><td><a href="/browse/{{.Name}}/">{{.Name}}</a></td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{template "foot"}}{{end}}
+
+{{define "source"}}{{template "head" .Source}}
+<p><a href="/browse/">&laquo; sources</a></p>
+<h1>{{.Source}}</h1>
+<p class="meta">{{len .Releases}} most recent</p>
+<table>
+<tr><th>published</th><th>title</th><th>permalink</th></tr>
+{{range .Releases}}<tr>
+<td>{{.Published}}</td>
+<td><a href="/browse/{{.Source}}/{{.ID}}">{{if .Title}}{{.Title}}{{else}}(no title){{end}}</a></td>
+<td><a href="{{.Permalink}}">{{.Permalink}}</a></td>
+</tr>
+{{end}}</table>
+{{template "foot"}}{{end}}
+
+{{define "release"}}{{template "head" .Title}}
+<p><a href="/browse/{{.Source}}/">&laquo; {{.Source}}</a></p>
+<h1>{{.Title}}</h1>
+<table class="meta">
+<tr><th>id</th><td>{{.ID}}</td></tr>
+<tr><th>published</th><td>{{.Published}}</td></tr>
+<tr><th>permalink</th><td><a href="{{.Permalink}}">{{.Permalink}}</a></td></tr>
+<tr><th>raw</th><td><a href="/api/releases/{{.ID}}/raw">page as scraped</a> (<a href="/api/releases/{{.ID}}/raw?format=json">headers</a>)</td></tr>
+</table>
+<div class="content">{{.Content}}</div>
+{{template "foot"}}{{end}}
+`))
+
+// browseRelease is a PressRelease massaged for display
+type browseRelease struct {
+	*PressRelease
+	ID        int
+	Published string
+}
+
+func newBrowseRelease(ev *pressReleaseEvent) *browseRelease {
+	return &browseRelease{ev.payload, ev.id, ev.payload.PubDate.Format("2006-01-02 15:04")}
+}
+
+func (b *browser) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/browse"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		b.sources(w, req)
+	case len(parts) == 1:
+		b.source(w, req, parts[0])
+	case len(parts) == 2:
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		b.release(w, req, parts[0], id)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (b *browser) sources(w http.ResponseWriter, req *http.Request) {
+	counts, err := b.store.SourceCounts()
+	if err != nil {
+		b.fail(w, err)
+		return
+	}
+	type sourceInfo struct {
+		Name  string
+		Count int
+	}
+	var sources []sourceInfo
+	for _, name := range b.scrapers.Names() {
+		sources = append(sources, sourceInfo{name, counts[name]})
+	}
+	b.render(w, "sources", sources)
+}
+
+func (b *browser) source(w http.ResponseWriter, req *http.Request, source string) {
+	evs, err := b.store.Recent(source, browseLimit)
+	if err != nil {
+		b.fail(w, err)
+		return
+	}
+	releases := make([]*browseRelease, len(evs))
+	for i, ev := range evs {
+		releases[i] = newBrowseRelease(ev)
+	}
+	b.render(w, "source", struct {
+		Source   string
+		Releases []*browseRelease
+	}{source, releases})
+}
+
+func (b *browser) release(w http.ResponseWriter, req *http.Request, source string, id int) {
+	ev, err := b.store.Fetch(id)
+	if err != nil {
+		b.fail(w, err)
+		return
+	}
+	if ev == nil || ev.payload.Source != source {
+		http.NotFound(w, req)
+		return
+	}
+	b.render(w, "release", newBrowseRelease(ev))
+}
+
+func (b *browser) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := browseTmpls.ExecuteTemplate(w, name, data); err != nil {
+		glog.Errorf("browse: %s", err)
+	}
+}
+
+func (b *browser) fail(w http.ResponseWriter, err error) {
+	glog.Errorf("browse: %s", err)
+	http.Error(w, "Internal error", http.StatusInternalServerError)
+}
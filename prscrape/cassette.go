@@ -0,0 +1,255 @@
+package prscrape
+
+// Recording and replaying of HTTP responses.
+//
+// A cassette is a directory of recorded responses. While recording, every
+// request made by a Fetcher goes out as normal, and the response is saved.
+// While replaying, responses come from the cassette instead of the
+// network, so runs can be repeated exactly (and offline).
+//
+// Each response is saved as two files, named by a hash of the url:
+//   <hash>.json  - the url, status code, headers and when it was recorded
+//   <hash>.body  - the body, exactly as received
+// If a url is fetched more than once (eg an index page polled by a server
+// run), the later responses are saved as <hash>.2.json, <hash>.3.json and
+// so on, and are replayed in the same order. Once they run out, the last
+// one is repeated. Recording over an old cassette replaces its responses.
+//
+// The -record and -replay flags run ukpr (in any mode, including -t) with
+// a cassette, so a run against the live sites can be saved and later
+// repeated exactly on a machine with no network access:
+//
+//   ukpr -t -record /tmp/run1 tesco
+//   ukpr -t -replay /tmp/run1 tesco
+//
+// Conditional requests aren't made while a cassette is in use (see
+// httpcache.go), and when replaying, robots.txt and the per-host delays
+// are ignored.
+//
+// The scraper regression tests keep each scraper's saved pages in a
+// cassette too (see regress_test.go).
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cassette records responses to (or replays them from) a directory
+type Cassette struct {
+	Dir string
+	// Record is set to record real responses, rather than replay them
+	Record bool
+
+	mu sync.Mutex
+	// url => number of responses recorded (or replayed) so far
+	count map[string]int
+}
+
+// the cassette in use (if any)
+var cassette struct {
+	sync.Mutex
+	c *Cassette
+}
+
+// UseCassette makes all requests go through c (nil to go back to normal)
+func UseCassette(c *Cassette) error {
+	if c != nil && c.Record {
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	cassette.Lock()
+	defer cassette.Unlock()
+	cassette.c = c
+	return nil
+}
+
+func currentCassette() *Cassette {
+	cassette.Lock()
+	defer cassette.Unlock()
+	return cassette.c
+}
+
+// replaying returns true if responses are coming from the cassette
+func (c *Cassette) replaying() bool {
+	return c != nil && !c.Record
+}
+
+// recording is the metadata saved for each response
+type recording struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Recorded   time.Time   `json:"recorded"`
+}
+
+// path returns the filename (minus extension) for the nth response to a url
+func (c *Cassette) path(u string, n int) string {
+	sum := sha1.Sum([]byte(u))
+	base := filepath.Join(c.Dir, hex.EncodeToString(sum[:8]))
+	if n > 1 {
+		base += "." + strconv.Itoa(n)
+	}
+	return base
+}
+
+// nextRecording returns the number of the next response to record for a url.
+// For the first, any responses left from an earlier recording are removed.
+func (c *Cassette) nextRecording(u string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count == nil {
+		c.count = make(map[string]int)
+	}
+	c.count[u]++
+	n := c.count[u]
+	if n == 1 {
+		for old := 2; ; old++ {
+			base := c.path(u, old)
+			if _, err := os.Stat(base + ".json"); os.IsNotExist(err) {
+				break
+			}
+			for _, ext := range []string{".json", ".body"} {
+				if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+					return 0, err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// nextReplay returns the number of the next response to replay for a url
+// (which stays at the last one once they run out)
+func (c *Cassette) nextReplay(u string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count == nil {
+		c.count = make(map[string]int)
+	}
+	n := c.count[u] + 1
+	if n > 1 {
+		if _, err := os.Stat(c.path(u, n) + ".json"); err != nil {
+			n--
+		}
+	}
+	c.count[u] = n
+	return n
+}
+
+// wrap returns a RoundTripper which records responses from real, or
+// replays them
+func (c *Cassette) wrap(real http.RoundTripper) http.RoundTripper {
+	return &cassetteTransport{c, real}
+}
+
+type cassetteTransport struct {
+	c    *Cassette
+	real http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.c.Record {
+		return t.c.record(t.real, req)
+	}
+	return t.c.replay(req)
+}
+
+func (c *Cassette) record(real http.RoundTripper, req *http.Request) (*http.Response, error) {
+	resp, err := real.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	meta, err := json.MarshalIndent(&recording{
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Recorded:   time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.nextRecording(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	base := c.path(req.URL.String(), n)
+	if err := writeFileAtomic(base+".body", body); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(base+".json", meta); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	base := c.path(req.URL.String(), c.nextReplay(req.URL.String()))
+	raw, err := ioutil.ReadFile(base + ".json")
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("not in cassette %s", c.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil, fmt.Errorf("%s.json: %s", base, err)
+	}
+	body, err := ioutil.ReadFile(base + ".body")
+	if err != nil {
+		return nil, err
+	}
+	if rec.Header == nil {
+		rec.Header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// writeFileAtomic writes a file via a temporary one, so a half-written
+// file is never left behind (even with several goroutines writing it)
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,94 @@
+package prscrape
+
+import (
+	"github.com/donovanhide/eventsource"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sseChannels routes incoming client connections to the right channel on
+// the eventsource server. Unlike registering a handler per channel with
+// http.Handle, channels can be added and removed while the server is
+// running.
+// Clients connected to a removed channel are disconnected. Everyone else
+// is left alone.
+// The control channel (see drift.go) is always served.
+type sseChannels struct {
+	sync.Mutex
+	srv  *eventsource.Server
+	repo eventsource.Repository
+	// one entry per channel, closed when the channel is removed
+	chans map[string]chan struct{}
+}
+
+func newSSEChannels(srv *eventsource.Server, repo eventsource.Repository) *sseChannels {
+	c := &sseChannels{
+		srv:   srv,
+		repo:  repo,
+		chans: make(map[string]chan struct{}),
+	}
+	srv.Register(controlChannel, noReplay{})
+	c.chans[controlChannel] = make(chan struct{})
+	return c
+}
+
+// Update sets the list of channels to serve.
+func (c *sseChannels) Update(names []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	wanted := map[string]bool{controlChannel: true}
+	for _, name := range names {
+		wanted[name] = true
+		if _, got := c.chans[name]; !got {
+			c.srv.Register(name, c.repo)
+			c.chans[name] = make(chan struct{})
+		}
+	}
+	for name, removed := range c.chans {
+		if !wanted[name] {
+			close(removed)
+			delete(c.chans, name)
+		}
+	}
+}
+
+// ServeHTTP handles requests of the form "/<channel>/"
+func (c *sseChannels) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+	c.Lock()
+	removed, ok := c.chans[name]
+	c.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	metricSSEClients.Add(1, name)
+	defer metricSSEClients.Dec(name)
+
+	sw := &sseWriter{w, make(chan bool, 1)}
+	go func() {
+		select {
+		case <-req.Context().Done():
+		case <-removed:
+		}
+		sw.closed <- true
+	}()
+	c.srv.Handler(name)(sw, req)
+}
+
+// sseWriter lets us kick clients off by faking a closed connection.
+type sseWriter struct {
+	http.ResponseWriter
+	closed chan bool
+}
+
+func (sw *sseWriter) CloseNotify() <-chan bool {
+	return sw.closed
+}
+
+func (sw *sseWriter) Flush() {
+	sw.ResponseWriter.(http.Flusher).Flush()
+}
@@ -0,0 +1,257 @@
+package prscrape
+
+// Support for declaring scrapers in a config file rather than in code.
+//
+// The config file is JSON, of the form:
+//
+//  {
+//    "scrapers": [
+//      {
+//        "name": "asda",
+//        "discover": {
+//          "method": "index",
+//          "url": "http://your.asda.com/press-centre/",
+//          "link_selector": "#main h2 a"
+//        },
+//        "scrape": {
+//          "title": "#main .article-content .title h1",
+//          "content": "#main .article-content .body",
+//          "pubdate": "#main .article-content .posted-by"
+//        }
+//      },
+//      ...
+//    ]
+//  }
+//
+// Discover methods are:
+//   "index"     - grab links from a single page (BuildGenericDiscover)
+//   "paginated" - grab links, following "next page" links (BuildPaginatedGenericDiscover)
+//   "rss"       - grab links (and maybe content) from rss/atom feeds (BuildRSSDiscover)
+//
+// If "scrape" is left out, the press releases are used exactly as returned
+// by discovery (eg for rss feeds which contain the full text).
+//
+// HTTP settings (timeout, user agent etc) can be given in a top-level
+// "fetch" section, and overridden in a "fetch" section for each scraper.
+// Validation rules work the same way, with "validate" sections.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the top-level structure of a config file
+type Config struct {
+	Fetch    *FetchConfig     `json:"fetch,omitempty"`
+	Validate *ValidateConfig  `json:"validate,omitempty"`
+	Scrapers []*ScraperConfig `json:"scrapers"`
+}
+
+// ScraperConfig describes a single scraper
+type ScraperConfig struct {
+	Name string `json:"name"`
+	// Comment is ignored - it's just there for notes (JSON has no comments)
+	Comment  string `json:"comment,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Interval is how often to run the scraper, in seconds (0 = use default)
+	Interval int `json:"interval,omitempty"`
+	// Retention is how many days to keep press releases for
+	// (0 = use default, -1 = keep forever)
+	Retention int `json:"retention,omitempty"`
+	// Recheck is how many hours after storing press releases to keep
+	// checking them for changes (0 = use default, -1 = never)
+	Recheck  int             `json:"recheck,omitempty"`
+	Discover *DiscoverConfig `json:"discover"`
+	// Historical is an optional alternative discover to use when running
+	// in historical mode (eg to step back through an archive)
+	Historical *DiscoverConfig `json:"historical,omitempty"`
+	Scrape     *ScrapeConfig   `json:"scrape,omitempty"`
+	Fetch      *FetchConfig    `json:"fetch,omitempty"`
+	Validate   *ValidateConfig `json:"validate,omitempty"`
+}
+
+// DiscoverConfig describes how to find press releases
+type DiscoverConfig struct {
+	Method           string   `json:"method"`
+	URL              string   `json:"url,omitempty"`
+	Feeds            []string `json:"feeds,omitempty"`
+	LinkSelector     string   `json:"link_selector,omitempty"`
+	NextPageSelector string   `json:"next_page_selector,omitempty"`
+	AllowHostChange  bool     `json:"allow_host_change,omitempty"`
+}
+
+// ScrapeConfig holds the css selectors used to scrape a press release page
+type ScrapeConfig struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Cruft   string `json:"cruft,omitempty"`
+	PubDate string `json:"pubdate,omitempty"`
+	// content is cut off at the first element matching EndSelector,
+	// or the first line of text matching any of the Ends regexps
+	EndSelector string   `json:"end_selector,omitempty"`
+	Ends        []string `json:"ends,omitempty"`
+}
+
+// FetchConfig holds HTTP settings. Anything left unset keeps its
+// existing value.
+type FetchConfig struct {
+	// Timeout is in seconds
+	Timeout     int               `json:"timeout,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	MaxBodySize int64             `json:"max_body_size,omitempty"`
+	Proxy       string            `json:"proxy,omitempty"`
+	// IgnoreRobots turns off robots.txt checking
+	IgnoreRobots bool `json:"ignore_robots,omitempty"`
+	// Retries is the number of retries for transient errors (0 = none)
+	Retries *int `json:"retries,omitempty"`
+}
+
+// apply returns a new Fetcher, based on base but with the config applied
+func (fc *FetchConfig) apply(base *Fetcher) *Fetcher {
+	if fc == nil {
+		return base
+	}
+	f := base.Clone()
+	if fc.Timeout > 0 {
+		f.Timeout = time.Duration(fc.Timeout) * time.Second
+	}
+	if fc.UserAgent != "" {
+		f.UserAgent = fc.UserAgent
+	}
+	for k, v := range fc.Headers {
+		f.Headers[k] = v
+	}
+	if fc.MaxBodySize > 0 {
+		f.MaxBodySize = fc.MaxBodySize
+	}
+	if fc.Proxy != "" {
+		f.Proxy = fc.Proxy
+	}
+	if fc.IgnoreRobots {
+		f.IgnoreRobots = true
+	}
+	if fc.Retries != nil {
+		f.Retries = *fc.Retries
+	}
+	return f
+}
+
+// readConfig reads in a config file, without building anything
+func readConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	err = json.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return &cfg, nil
+}
+
+// LoadConfig reads a config file and builds all the (enabled) scrapers in it
+func LoadConfig(filename string, historical bool) ([]*Scraper, error) {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	base := cfg.Fetch.apply(DefaultFetcher)
+	baseRules, err := cfg.Validate.apply(DefaultValidation)
+	if err != nil {
+		return nil, fmt.Errorf("%s: validate: %s", filename, err)
+	}
+	out := make([]*Scraper, 0, len(cfg.Scrapers))
+	seen := make(map[string]bool)
+	for _, sc := range cfg.Scrapers {
+		if sc.Disabled {
+			continue
+		}
+		if seen[sc.Name] {
+			return nil, fmt.Errorf("%s: scraper '%s' defined more than once", filename, sc.Name)
+		}
+		seen[sc.Name] = true
+		scraper, err := sc.Build(historical, base, baseRules)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		out = append(out, scraper)
+	}
+	return out, nil
+}
+
+// Build creates a Scraper from the config.
+// base holds the default HTTP settings (nil = DefaultFetcher), and
+// baseRules the default validation rules (nil = DefaultValidation).
+func (sc *ScraperConfig) Build(historical bool, base *Fetcher, baseRules *ValidationRules) (*Scraper, error) {
+	if sc.Name == "" {
+		return nil, fmt.Errorf("scraper missing name")
+	}
+	if base == nil {
+		base = DefaultFetcher
+	}
+	if baseRules == nil {
+		baseRules = DefaultValidation
+	}
+	fetcher := sc.Fetch.apply(base)
+	rules, err := sc.Validate.apply(baseRules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad validate: %s", sc.Name, err)
+	}
+	dc := sc.Discover
+	if historical && sc.Historical != nil {
+		dc = sc.Historical
+	}
+	if dc == nil {
+		return nil, fmt.Errorf("%s: missing discover", sc.Name)
+	}
+	discover, err := dc.build(sc.Name, fetcher)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad discover: %s", sc.Name, err)
+	}
+
+	scraper := &Scraper{
+		Name:       sc.Name,
+		Discover:   discover,
+		Interval:   time.Duration(sc.Interval) * time.Second,
+		Retention:  time.Duration(sc.Retention) * 24 * time.Hour,
+		Recheck:    time.Duration(sc.Recheck) * time.Hour,
+		Fetcher:    fetcher,
+		Validation: rules,
+	}
+	if sc.Scrape != nil {
+		s := sc.Scrape
+		scraper.Scrape, err = BuildGenericScrapeWithEnds(sc.Name, s.Title, s.Content, s.Cruft, s.PubDate, s.EndSelector, s.Ends)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad scrape: %s", sc.Name, err)
+		}
+	}
+	return scraper, nil
+}
+
+func (dc *DiscoverConfig) build(scraperName string, f *Fetcher) (DiscoverFunc, error) {
+	switch dc.Method {
+	case "index":
+		if dc.URL == "" || dc.LinkSelector == "" {
+			return nil, fmt.Errorf("index needs url and link_selector")
+		}
+		return f.BuildGenericDiscover(scraperName, dc.URL, dc.LinkSelector, dc.AllowHostChange)
+	case "paginated":
+		if dc.URL == "" || dc.LinkSelector == "" || dc.NextPageSelector == "" {
+			return nil, fmt.Errorf("paginated needs url, link_selector and next_page_selector")
+		}
+		return f.BuildPaginatedGenericDiscover(scraperName, dc.URL, dc.NextPageSelector, dc.LinkSelector)
+	case "rss":
+		if len(dc.Feeds) == 0 {
+			return nil, fmt.Errorf("rss needs feeds")
+		}
+		return f.BuildRSSDiscover(scraperName, dc.Feeds)
+	}
+	return nil, fmt.Errorf("unknown method '%s'", dc.Method)
+}
@@ -6,11 +6,12 @@
 // 3) serves up the scraped press releases via HTTP, as server side event
 //    endpoints
 //
-// The scraped press releases are persistent, in a sqlite db. The idea is
-// that eventually it'll be set up to keep just a week or so archive, to let
-// consumers of the stream have a chance to catch up if they go down for a
-// day or two.
-// (but for now, it just keeps adding to the db)
+// The scraped press releases are persistent, in a sqlite db. Old press
+// releases are pruned after a retention period (-retention flag, with
+// per-source overrides in the config file), eg keeping just a week or so
+// archive, to let consumers of the stream have a chance to catch up if they
+// go down for a day or two. Press releases which a recently-seen client
+// might still need to resume from are never pruned.
 //
 // Clients connect to:
 //
@@ -0,0 +1,220 @@
+package prscrape
+
+// Selector drift detection.
+//
+// When a site is redesigned, its scraper's selectors tend to quietly stop
+// matching - discovery finds no links, or every press release fails to
+// scrape - and nobody notices for days. So the generic discover and scrape
+// functions report how each of their selectors got on, and a selector
+// which had been working but then comes up empty DriftMisses times in a
+// row is flagged as having drifted:
+//   - a warning is logged
+//   - it's shown on /status (and in the json version)
+//   - a "selector_drift" event is sent out on the "_control" SSE channel
+// When it starts working again, a "selector_recovered" event follows.
+//
+// Like the status, the history is only held in memory.
+
+import (
+	"encoding/json"
+	"github.com/donovanhide/eventsource"
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DriftMisses is the number of times in a row a selector has to come up
+// empty before it's considered to have drifted
+var DriftMisses = 3
+
+// DriftMinHits is the number of times a selector has to have worked
+// before it can drift (so a selector which never worked isn't reported
+// as drifting - that's just broken)
+var DriftMinHits = 3
+
+// driftHistory is the number of recent match counts kept for each selector
+const driftHistory = 10
+
+// SelectorStatus holds the history of one of a scraper's selectors
+type SelectorStatus struct {
+	// Role is what the selector is for ("link_selector", "title",
+	// "pubdate" or "content")
+	Role     string `json:"role"`
+	Selector string `json:"selector"`
+	// Uses is the number of pages the selector has been run on, and Hits
+	// the number of those where it produced something (links, a title...)
+	Uses int `json:"uses"`
+	Hits int `json:"hits"`
+	// Recent holds the number of elements matched on the most recent
+	// pages, oldest first
+	Recent  []int     `json:"recent"`
+	LastHit time.Time `json:"last_hit"`
+	// Misses is the number of times in a row it's produced nothing
+	Misses    int       `json:"misses"`
+	Drifted   bool      `json:"drifted"`
+	DriftedAt time.Time `json:"drifted_at"`
+}
+
+// driftAlert is sent out when a selector drifts (or recovers)
+type driftAlert struct {
+	Scraper  string    `json:"scraper"`
+	Role     string    `json:"role"`
+	Selector string    `json:"selector"`
+	Drifted  bool      `json:"drifted"`
+	LastHit  time.Time `json:"last_hit"`
+	Misses   int       `json:"misses"`
+	// URL is the page it was last run on
+	URL string `json:"url"`
+}
+
+// controlChannel is the SSE channel for events about the scrapers
+// themselves, rather than press releases
+const controlChannel = "_control"
+
+// driftEvent is the SSE event for a driftAlert. Like update events, they
+// have no id, so aren't replayed.
+type driftEvent struct {
+	alert *driftAlert
+}
+
+func (ev *driftEvent) Id() string { return "" }
+
+func (ev *driftEvent) Event() string {
+	if ev.alert.Drifted {
+		return "selector_drift"
+	}
+	return "selector_recovered"
+}
+
+func (ev *driftEvent) Data() string {
+	out, err := json.Marshal(ev.alert)
+	if err != nil {
+		panic(err)
+	}
+	return string(out)
+}
+
+// driftTracker holds the selector histories of all the scrapers
+type driftTracker struct {
+	sync.Mutex
+	// scraper name => role => status
+	scrapers map[string]map[string]*SelectorStatus
+	// notify (if set) is called whenever a selector drifts or recovers
+	notify func(*driftAlert)
+}
+
+// drift is the tracker used by the generic discover and scrape functions
+var drift = &driftTracker{scrapers: make(map[string]map[string]*SelectorStatus)}
+
+// Notify sets a function to call whenever a selector drifts or recovers
+func (dt *driftTracker) Notify(fn func(*driftAlert)) {
+	dt.Lock()
+	defer dt.Unlock()
+	dt.notify = fn
+}
+
+// Record notes how a selector did on a page. matches is the number of
+// elements it matched, and ok is set if anything useful came out of them.
+func (dt *driftTracker) Record(scraperName, role, selector string, matches int, ok bool, pageURL string) {
+	alert := dt.record(scraperName, role, selector, matches, ok, pageURL)
+	if alert == nil {
+		return
+	}
+	if alert.Drifted {
+		metricDrifted.Inc(scraperName, role)
+		glog.Warningf("%s: %s selector \"%s\" has stopped matching (nothing from the last %d pages, last worked %s) - site changed?", scraperName, role, selector, alert.Misses, alert.LastHit.Format(time.RFC3339))
+	} else {
+		glog.Infof("%s: %s selector \"%s\" is matching again", scraperName, role, selector)
+	}
+	dt.Lock()
+	notify := dt.notify
+	dt.Unlock()
+	if notify != nil {
+		notify(alert)
+	}
+}
+
+// record updates the history, returning an alert if the selector has
+// drifted or recovered
+func (dt *driftTracker) record(scraperName, role, selector string, matches int, ok bool, pageURL string) *driftAlert {
+	dt.Lock()
+	defer dt.Unlock()
+	roles, got := dt.scrapers[scraperName]
+	if !got {
+		roles = make(map[string]*SelectorStatus)
+		dt.scrapers[scraperName] = roles
+	}
+	st, got := roles[role]
+	if !got || st.Selector != selector {
+		// new (or changed) selector - start afresh
+		st = &SelectorStatus{Role: role, Selector: selector}
+		roles[role] = st
+	}
+
+	st.Uses++
+	st.Recent = append(st.Recent, matches)
+	if len(st.Recent) > driftHistory {
+		st.Recent = st.Recent[len(st.Recent)-driftHistory:]
+	}
+	if ok {
+		st.Hits++
+		st.LastHit = time.Now()
+		st.Misses = 0
+		if st.Drifted {
+			st.Drifted = false
+			st.DriftedAt = time.Time{}
+			return st.alert(scraperName, pageURL)
+		}
+		return nil
+	}
+	st.Misses++
+	if !st.Drifted && st.Hits >= DriftMinHits && st.Misses >= DriftMisses {
+		st.Drifted = true
+		st.DriftedAt = time.Now()
+		return st.alert(scraperName, pageURL)
+	}
+	return nil
+}
+
+func (st *SelectorStatus) alert(scraperName, pageURL string) *driftAlert {
+	return &driftAlert{
+		Scraper:  scraperName,
+		Role:     st.Role,
+		Selector: st.Selector,
+		Drifted:  st.Drifted,
+		LastHit:  st.LastHit,
+		Misses:   st.Misses,
+		URL:      pageURL,
+	}
+}
+
+// Get returns a copy of the selector histories for a scraper, sorted by
+// role
+func (dt *driftTracker) Get(scraperName string) []*SelectorStatus {
+	dt.Lock()
+	defer dt.Unlock()
+	out := []*SelectorStatus{}
+	for _, st := range dt.scrapers[scraperName] {
+		cpy := *st
+		cpy.Recent = append([]int(nil), st.Recent...)
+		out = append(out, &cpy)
+	}
+	sort.Sort(byRole(out))
+	return out
+}
+
+type byRole []*SelectorStatus
+
+func (s byRole) Len() int           { return len(s) }
+func (s byRole) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRole) Less(i, j int) bool { return s[i].Role < s[j].Role }
+
+// noReplay is the Repository for channels with nothing to replay
+type noReplay struct{}
+
+func (noReplay) Replay(channel, lastEventId string) chan eventsource.Event {
+	out := make(chan eventsource.Event)
+	close(out)
+	return out
+}
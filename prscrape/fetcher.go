@@ -0,0 +1,299 @@
+package prscrape
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fetcher performs all the HTTP requests made by discover and scrape
+// functions, so that timeouts, headers, proxies etc can be controlled in
+// one place.
+//
+// Responses are transparently gzip-decompressed (we advertise gzip support
+// via the standard Accept-Encoding header).
+type Fetcher struct {
+	// Timeout is the time allowed for a whole request, including reading
+	// the body (0 = no timeout)
+	Timeout   time.Duration
+	UserAgent string
+	// Headers holds any extra request headers to send
+	Headers map[string]string
+	// MaxBodySize limits the size of responses we'll accept
+	// (0 = no limit)
+	MaxBodySize int64
+	// Proxy is the url of the http proxy to use. If empty, no proxy is
+	// used (the HTTP_PROXY environment variable is ignored).
+	Proxy string
+	// Cache, if set, is used to make conditional requests for discovery
+	// pages and feeds (see fetchIfModified)
+	Cache HTTPCache
+	// IgnoreRobots turns off robots.txt checking (the per-host rate
+	// limits still apply)
+	IgnoreRobots bool
+	// Retries is the number of times to retry a request which fails with
+	// a transient error (timeouts, 503s etc). The delay between attempts
+	// starts at RetryDelay and doubles each time.
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// DefaultFetcher is used by scrapers which don't specify their own
+var DefaultFetcher = &Fetcher{
+	Timeout:     60 * time.Second,
+	UserAgent:   "ukpr (+https://github.com/bcampbell/ukpr)",
+	MaxBodySize: 10 * 1024 * 1024,
+	Retries:     3,
+	RetryDelay:  2 * time.Second,
+}
+
+// Clone returns a copy of the fetcher, for customising
+func (f *Fetcher) Clone() *Fetcher {
+	out := *f
+	out.Headers = make(map[string]string)
+	for k, v := range f.Headers {
+		out.Headers[k] = v
+	}
+	return &out
+}
+
+// fetchResult holds a fetched response
+type fetchResult struct {
+	// URL is where the response actually came from, after any redirects
+	URL *url.URL
+	// Redirects holds the urls we were redirected through to get to URL
+	// (starting with the one requested)
+	Redirects  []string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Fetched is when the response came in
+	Fetched time.Time
+}
+
+// httpError is returned for non-2xx responses
+type httpError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("HTTP code %d (%s)", e.StatusCode, e.URL)
+}
+
+// transports are shared, one per proxy setting, so connections get reused
+var transports = struct {
+	sync.Mutex
+	m map[string]*http.Transport
+}{m: make(map[string]*http.Transport)}
+
+// transport returns the RoundTripper to make requests with (going via the
+// cassette, if there is one - see cassette.go)
+func (f *Fetcher) transport() (http.RoundTripper, error) {
+	t, err := f.netTransport()
+	if err != nil {
+		return nil, err
+	}
+	if c := currentCassette(); c != nil {
+		return c.wrap(t), nil
+	}
+	return t, nil
+}
+
+func (f *Fetcher) netTransport() (*http.Transport, error) {
+	transports.Lock()
+	defer transports.Unlock()
+	if t, ok := transports.m[f.Proxy]; ok {
+		return t, nil
+	}
+	t := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if f.Proxy != "" {
+		proxyURL, err := url.Parse(f.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy: %s", err)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	transports.m[f.Proxy] = t
+	return t, nil
+}
+
+// fetch performs a GET request.
+// Responses other than 2xx are treated as errors.
+func (f *Fetcher) fetch(u *url.URL) (*fetchResult, error) {
+	return f.fetchWithHeaders(u, nil)
+}
+
+// fetchWithHeaders performs a GET request, with some extra request headers.
+// A "304 Not Modified" response gives errNotModified, and urls disallowed
+// by robots.txt give errRobots.
+func (f *Fetcher) fetchWithHeaders(u *url.URL, hdr http.Header) (*fetchResult, error) {
+	// (no need to be polite to a cassette)
+	replaying := currentCassette().replaying()
+	if !f.IgnoreRobots && !replaying && !f.allowed(getHost(u.Host), u) {
+		glog.Infof("robots.txt disallows %s - skipping", u)
+		return nil, errRobots
+	}
+	delay := f.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := f.get(u, hdr)
+		if err == nil || attempt >= f.Retries || replaying || !isTransient(err) {
+			return resp, err
+		}
+		// add a little randomness, so retries don't all bunch up
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		if glog.V(1) {
+			glog.Infof("%s - retrying in %s", err, wait)
+		}
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// isTransient returns true if err looks like it might go away if we try
+// again (network problems, overloaded servers)
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *httpError:
+		switch e.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	case *url.Error:
+		// (but not, eg, redirect loops)
+		return e.Err == io.EOF || e.Err == io.ErrUnexpectedEOF || isNetError(e.Err)
+	}
+	// errors reading the body
+	return err == io.ErrUnexpectedEOF || isNetError(err)
+}
+
+func isNetError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// get performs a GET request, observing the per-host limits
+func (f *Fetcher) get(u *url.URL, hdr http.Header) (*fetchResult, error) {
+	host := getHost(u.Host)
+	return f.getFrom(host, host.crawlDelay(robotsAgent(f.UserAgent)), u, hdr)
+}
+
+// getFrom performs a GET request, waiting until delay has passed since the
+// previous request to the host
+func (f *Fetcher) getFrom(host *hostState, delay time.Duration, u *url.URL, hdr http.Header) (*fetchResult, error) {
+	if currentCassette().replaying() {
+		delay = 0
+	}
+	host.acquire(delay)
+	defer host.release()
+
+	start := time.Now()
+	resp, err := f.do(u, hdr)
+	metricFetchDuration.ObserveSince(start, u.Host)
+	code := "error"
+	switch {
+	case resp != nil:
+		code = strconv.Itoa(resp.StatusCode)
+	case err == errNotModified:
+		code = "304"
+	}
+	if e, ok := err.(*httpError); ok {
+		code = strconv.Itoa(e.StatusCode)
+	}
+	metricFetchResponses.Inc(u.Host, code)
+	return resp, err
+}
+
+// do performs the actual request
+func (f *Fetcher) do(u *url.URL, hdr http.Header) (*fetchResult, error) {
+	transport, err := f.transport()
+	if err != nil {
+		return nil, err
+	}
+	var redirects []string
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   f.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			redirects = append(redirects, via[len(via)-1].URL.String())
+			// keep our headers on the redirected request
+			f.setHeaders(req)
+			return nil
+		},
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	f.setHeaders(req)
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &httpError{resp.StatusCode, u.String()}
+	}
+
+	var r io.Reader = resp.Body
+	if f.MaxBodySize > 0 {
+		r = io.LimitReader(r, f.MaxBodySize+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.MaxBodySize > 0 && int64(len(body)) > f.MaxBodySize {
+		return nil, fmt.Errorf("response too big (over %d bytes) (%s)", f.MaxBodySize, u.String())
+	}
+
+	return &fetchResult{
+		URL:        resp.Request.URL,
+		Redirects:  redirects,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Fetched:    time.Now(),
+	}, nil
+}
+
+func (f *Fetcher) setHeaders(req *http.Request) {
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	for k, v := range f.Headers {
+		req.Header.Set(k, v)
+	}
+}
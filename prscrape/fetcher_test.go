@@ -0,0 +1,90 @@
+package prscrape
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&httpError{StatusCode: http.StatusRequestTimeout}, true},
+		{&httpError{StatusCode: http.StatusTooManyRequests}, true},
+		{&httpError{StatusCode: http.StatusInternalServerError}, true},
+		{&httpError{StatusCode: http.StatusBadGateway}, true},
+		{&httpError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&httpError{StatusCode: http.StatusGatewayTimeout}, true},
+		{&httpError{StatusCode: http.StatusNotFound}, false},
+		{&httpError{StatusCode: http.StatusForbidden}, false},
+		{&httpError{StatusCode: http.StatusNotImplemented}, false},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: netErr}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("stopped after 10 redirects")}, false},
+		{io.ErrUnexpectedEOF, true},
+		{netErr, true},
+		{errRobots, false},
+		{errNotModified, false},
+		{errors.New("bad html"), false},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.expected {
+			t.Errorf("%s: got %t, expected %t", test.err, got, test.expected)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	defer func(d time.Duration) { HostDelay = d }(HostDelay)
+	HostDelay = 0
+
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int // served in turn (the last one repeats)
+		ok       bool
+		attempts int32
+	}{
+		{"no retries", 0, []int{503, 200}, false, 1},
+		{"recovers", 2, []int{503, 503, 200}, true, 3},
+		{"gives up", 2, []int{503, 503, 503, 200}, false, 3},
+		{"dropped connection", 1, []int{-1, 200}, true, 2},
+		{"not transient", 3, []int{404, 200}, false, 1},
+		{"first time", 3, []int{200}, true, 1},
+	}
+	for _, test := range tests {
+		var attempts int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(atomic.AddInt32(&attempts, 1)) - 1
+			if n >= len(test.statuses) {
+				n = len(test.statuses) - 1
+			}
+			status := test.statuses[n]
+			if status < 0 {
+				// hang up without a response
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("hello"))
+		}))
+		f := &Fetcher{IgnoreRobots: true, Retries: test.retries, RetryDelay: time.Millisecond}
+		u, _ := url.Parse(srv.URL + "/page")
+		_, err := f.fetch(u)
+		srv.Close()
+		if (err == nil) != test.ok || attempts != test.attempts {
+			t.Errorf("%s: got err=%v after %d attempts, expected ok=%t after %d", test.name, err, attempts, test.ok, test.attempts)
+		}
+	}
+}
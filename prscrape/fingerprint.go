@@ -0,0 +1,326 @@
+package prscrape
+
+// Duplicate detection.
+//
+// The same press release often turns up from several sources (the company
+// site, PR Newswire, PRWeb...), with slightly different formatting or
+// boilerplate. Each stored press release gets:
+//   - a fingerprint: a hash of its normalised text, for exact copies
+//   - a minhash signature of its word shingles, for near-copies
+// and is put into a duplicate group with any earlier copies. The group id
+// is the id of the first press release in the group.
+//
+// Near-copies are found using locality-sensitive hashing - the signature
+// is split into bands, and press releases sharing any band are compared
+// properly.
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DupThreshold is the estimated similarity (jaccard index of the word
+// shingles) above which two press releases are considered copies
+var DupThreshold = 0.8
+
+const (
+	shingleSize = 5
+	minhashSize = 64
+	minhashBand = 4 // rows per band
+)
+
+// minhashSeeds are used to derive minhashSize hash functions from one
+var minhashSeeds = func() []uint64 {
+	seeds := make([]uint64, minhashSize)
+	x := uint64(0x5eed)
+	for i := range seeds {
+		x = mix64(x + 0x9e3779b97f4a7c15)
+		seeds[i] = x
+	}
+	return seeds
+}()
+
+// mix64 is the splitmix64 finaliser
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// fingerprint holds the duplicate-detection data for a press release
+type fingerprint struct {
+	// hash of the normalised text
+	exact string
+	// minhash signature (nil if the text is too short to shingle)
+	minhash []uint32
+}
+
+// normaliseWords splits text into lowercase words, ignoring punctuation
+func normaliseWords(txt string) []string {
+	return strings.FieldsFunc(strings.ToLower(txt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func newFingerprint(pr *PressRelease) *fingerprint {
+	words := normaliseWords(pr.Title + "\n" + pr.Content)
+	sum := sha1.Sum([]byte(strings.Join(words, " ")))
+	fp := &fingerprint{exact: hex.EncodeToString(sum[:])}
+
+	// the title is left out of the shingles - it's often rewritten
+	words = normaliseWords(pr.Content)
+	if len(words) < shingleSize {
+		return fp
+	}
+	mins := make([]uint64, minhashSize)
+	for i := range mins {
+		mins[i] = ^uint64(0)
+	}
+	for i := 0; i+shingleSize <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		shingle := h.Sum64()
+		for j, seed := range minhashSeeds {
+			if v := mix64(shingle ^ seed); v < mins[j] {
+				mins[j] = v
+			}
+		}
+	}
+	fp.minhash = make([]uint32, minhashSize)
+	for i, v := range mins {
+		fp.minhash[i] = uint32(v >> 32)
+	}
+	return fp
+}
+
+// similarity estimates the jaccard index of the two shingle sets
+func (fp *fingerprint) similarity(other []uint32) float64 {
+	if fp.minhash == nil || len(other) != len(fp.minhash) {
+		return 0
+	}
+	same := 0
+	for i, v := range fp.minhash {
+		if other[i] == v {
+			same++
+		}
+	}
+	return float64(same) / float64(len(fp.minhash))
+}
+
+// bands returns the LSH band hashes of the signature
+func (fp *fingerprint) bands() []int64 {
+	if fp.minhash == nil {
+		return nil
+	}
+	out := make([]int64, 0, minhashSize/minhashBand)
+	for i := 0; i < len(fp.minhash); i += minhashBand {
+		h := fnv.New64a()
+		for _, v := range fp.minhash[i : i+minhashBand] {
+			h.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+		out = append(out, int64(h.Sum64()))
+	}
+	return out
+}
+
+func (fp *fingerprint) encodeMinhash() sql.NullString {
+	if fp.minhash == nil {
+		return sql.NullString{}
+	}
+	parts := make([]string, len(fp.minhash))
+	for i, v := range fp.minhash {
+		parts[i] = strconv.FormatUint(uint64(v), 16)
+	}
+	return sql.NullString{String: strings.Join(parts, ","), Valid: true}
+}
+
+func decodeMinhash(s string) []uint32 {
+	parts := strings.Split(s, ",")
+	out := make([]uint32, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return nil
+		}
+		out[i] = uint32(v)
+	}
+	return out
+}
+
+// initFingerprints sets up the duplicate detection columns and tables,
+// fingerprinting any press releases already in the db.
+func (store *DBStore) initFingerprints() {
+	_, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS press_release_band (
+         id INTEGER PRIMARY KEY,
+         press_release_id INTEGER NOT NULL,
+         band INTEGER NOT NULL,
+         hash INTEGER NOT NULL )`)
+	if err != nil {
+		panic(err)
+	}
+	stmts := []string{
+		`CREATE INDEX IF NOT EXISTS press_release_fingerprint ON press_release(fingerprint)`,
+		`CREATE INDEX IF NOT EXISTS press_release_band_hash ON press_release_band(band,hash)`,
+		`CREATE INDEX IF NOT EXISTS press_release_band_pr ON press_release_band(press_release_id)`,
+		`CREATE TRIGGER IF NOT EXISTS press_release_band_del AFTER DELETE ON press_release BEGIN
+           DELETE FROM press_release_band WHERE press_release_id=old.id;
+         END`,
+	}
+
+	if !store.hasColumn("press_release", "dup_group") {
+		fmt.Printf("ADDING duplicate detection columns...")
+		for _, stmt := range []string{
+			"ALTER TABLE press_release ADD COLUMN fingerprint TEXT",
+			"ALTER TABLE press_release ADD COLUMN minhash TEXT",
+			"ALTER TABLE press_release ADD COLUMN dup_group INTEGER",
+		} {
+			if _, err := store.db.Exec(stmt); err != nil {
+				panic(err)
+			}
+		}
+		fmt.Printf("done.\n")
+	}
+	for _, stmt := range stmts {
+		if _, err := store.db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+
+	var cnt int
+	err = store.db.QueryRow("SELECT COUNT(*) FROM press_release WHERE dup_group IS NULL").Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	if cnt == 0 {
+		return
+	}
+	fmt.Printf("FINGERPRINTING %d press releases...", cnt)
+
+	// go through existing press releases in order, so the groups come out
+	// the same as if they'd been fingerprinted as they were stashed
+	rows, err := store.db.Query("SELECT id,title,content FROM press_release WHERE dup_group IS NULL ORDER BY id")
+	if err != nil {
+		panic(err)
+	}
+	type existing struct {
+		id int64
+		pr *PressRelease
+	}
+	var all []existing
+	for rows.Next() {
+		e := existing{pr: &PressRelease{}}
+		if err := rows.Scan(&e.id, &e.pr.Title, &e.pr.Content); err != nil {
+			panic(err)
+		}
+		all = append(all, e)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	rows.Close()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range all {
+		if _, err := setFingerprint(tx, e.id, newFingerprint(e.pr)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("done.\n")
+}
+
+// setFingerprint stores the fingerprint for a press release and assigns it
+// to a duplicate group. Returns the group id.
+func setFingerprint(tx *sql.Tx, id int64, fp *fingerprint) (int64, error) {
+	group, err := findDupGroup(tx, id, fp)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE press_release SET fingerprint=$1, minhash=$2, dup_group=$3 WHERE id=$4", fp.exact, fp.encodeMinhash(), group, id)
+	if err != nil {
+		return 0, err
+	}
+	return group, insertBands(tx, id, fp)
+}
+
+// refingerprint replaces the fingerprint of a press release which has
+// changed. It stays in the same duplicate group.
+func refingerprint(tx *sql.Tx, id int64, fp *fingerprint) error {
+	_, err := tx.Exec("UPDATE press_release SET fingerprint=$1, minhash=$2 WHERE id=$3", fp.exact, fp.encodeMinhash(), id)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM press_release_band WHERE press_release_id=$1", id); err != nil {
+		return err
+	}
+	return insertBands(tx, id, fp)
+}
+
+func insertBands(tx *sql.Tx, id int64, fp *fingerprint) error {
+	for band, hash := range fp.bands() {
+		_, err := tx.Exec("INSERT INTO press_release_band (press_release_id,band,hash) VALUES ($1,$2,$3)", id, band, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDupGroup returns the group of the best earlier match for fp, or id
+// if there isn't one.
+func findDupGroup(tx *sql.Tx, id int64, fp *fingerprint) (int64, error) {
+	// exact copy?
+	var group int64
+	err := tx.QueryRow("SELECT dup_group FROM press_release WHERE fingerprint=$1 AND id<$2 AND dup_group IS NOT NULL ORDER BY id LIMIT 1", fp.exact, id).Scan(&group)
+	if err == nil {
+		return group, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// near copy?
+	bands := fp.bands()
+	if len(bands) == 0 {
+		return id, nil
+	}
+	where := make([]string, len(bands))
+	args := []interface{}{id}
+	for band, hash := range bands {
+		where[band] = "(b.band=? AND b.hash=?)"
+		args = append(args, band, hash)
+	}
+	rows, err := tx.Query(`SELECT DISTINCT p.id, p.minhash, p.dup_group
+       FROM press_release_band b JOIN press_release p ON p.id=b.press_release_id
+       WHERE p.id<? AND p.dup_group IS NOT NULL AND (`+strings.Join(where, " OR ")+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	best, bestSim := id, DupThreshold
+	for rows.Next() {
+		var otherID, otherGroup int64
+		var minhash sql.NullString
+		if err := rows.Scan(&otherID, &minhash, &otherGroup); err != nil {
+			return 0, err
+		}
+		if !minhash.Valid {
+			continue
+		}
+		if sim := fp.similarity(decodeMinhash(minhash.String)); sim >= bestSim {
+			best, bestSim = otherGroup, sim
+		}
+	}
+	return best, rows.Err()
+}
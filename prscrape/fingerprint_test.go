@@ -0,0 +1,145 @@
+package prscrape
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore returns a DBStore backed by an in-memory db
+func testStore(t *testing.T) *DBStore {
+	// (shared cache, so all the connections in the pool see the same db)
+	store := NewDBStore(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	t.Cleanup(func() { store.db.Close() })
+	return store
+}
+
+// dupText makes up a press release body from a sentence (with two %d
+// verbs), with some boilerplate at the end
+func dupText(sentence string, boilerplate string) string {
+	var parts []string
+	for i := 1; i <= 60; i++ {
+		parts = append(parts, fmt.Sprintf(sentence, i, i*7))
+	}
+	return strings.Join(parts, "\n") + "\n" + boilerplate
+}
+
+const (
+	widgets      = "The widget range now includes model %d, which ships to %d stores from next week."
+	gadgets      = "Gadget sales at branch %d rose by %d percent in the year to March."
+	boilerplate1 = "About Acme: Acme Ltd is the leading supplier of widgets in the UK. For more information please contact the press office on 020 7946 0000."
+	boilerplate2 = "Notes to editors: Acme plc, founded in 1952, employs 4,000 people across Europe. Media enquiries to press@acme.example."
+)
+
+func TestFingerprint(t *testing.T) {
+	orig := &PressRelease{Title: "Acme launches widgets", Content: dupText(widgets, boilerplate1)}
+	tests := []struct {
+		name   string
+		pr     *PressRelease
+		exact  bool
+		minSim float64
+		maxSim float64
+	}{
+		{"exact copy", &PressRelease{Title: orig.Title, Content: orig.Content}, true, 1, 1},
+		{"reformatted copy", &PressRelease{Title: "ACME LAUNCHES WIDGETS!", Content: strings.Replace(orig.Content, "\n", "\n\n  ", -1)}, true, 1, 1},
+		{"new title", &PressRelease{Title: "Widgets from Acme", Content: orig.Content}, false, 1, 1},
+		{"changed boilerplate", &PressRelease{Title: orig.Title, Content: dupText(widgets, boilerplate2)}, false, DupThreshold, 1},
+		{"unrelated", &PressRelease{Title: "Acme launches gadgets", Content: dupText(gadgets, boilerplate1)}, false, 0, 0.2},
+	}
+	fp := newFingerprint(orig)
+	for _, test := range tests {
+		other := newFingerprint(test.pr)
+		if got := other.exact == fp.exact; got != test.exact {
+			t.Errorf("%s: got exact %t, expected %t", test.name, got, test.exact)
+		}
+		if sim := fp.similarity(other.minhash); sim < test.minSim || sim > test.maxSim {
+			t.Errorf("%s: got similarity %.2f, expected %.2f-%.2f", test.name, sim, test.minSim, test.maxSim)
+		}
+	}
+}
+
+func TestFingerprintShort(t *testing.T) {
+	fp := newFingerprint(&PressRelease{Title: "Short", Content: "too short to shingle"})
+	if fp.minhash != nil || fp.bands() != nil || fp.encodeMinhash().Valid {
+		t.Errorf("expected no minhash for short text")
+	}
+	if fp.similarity(fp.minhash) != 0 {
+		t.Errorf("expected zero similarity for short text")
+	}
+}
+
+func TestFingerprintBands(t *testing.T) {
+	a := newFingerprint(&PressRelease{Content: dupText(widgets, boilerplate1)})
+	b := newFingerprint(&PressRelease{Content: dupText(widgets, boilerplate2)})
+	c := newFingerprint(&PressRelease{Content: dupText(gadgets, boilerplate1)})
+	if len(a.bands()) != minhashSize/minhashBand {
+		t.Fatalf("got %d bands, expected %d", len(a.bands()), minhashSize/minhashBand)
+	}
+	shared := func(x, y *fingerprint) int {
+		n := 0
+		for i, h := range x.bands() {
+			if y.bands()[i] == h {
+				n++
+			}
+		}
+		return n
+	}
+	if n := shared(a, b); n == 0 {
+		t.Errorf("near copy: expected some bands in common, got none")
+	}
+	if n := shared(a, c); n != 0 {
+		t.Errorf("unrelated: expected no bands in common, got %d", n)
+	}
+
+	// survives the trip through the db
+	if got := decodeMinhash(a.encodeMinhash().String); a.similarity(got) != 1 {
+		t.Errorf("minhash changed after encoding")
+	}
+}
+
+func TestDupGroups(t *testing.T) {
+	store := testStore(t)
+	when := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	stash := func(source, title, content string) int {
+		ev, err := store.Stash(&PressRelease{
+			Title:     title,
+			Source:    source,
+			Permalink: "http://" + source + ".example/" + strings.Replace(strings.ToLower(title), " ", "-", -1),
+			PubDate:   when,
+			Content:   content,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev.id
+	}
+
+	orig := stash("acme", "Acme launches widgets", dupText(widgets, boilerplate1))
+	tests := []struct {
+		name    string
+		source  string
+		title   string
+		content string
+		dup     bool
+	}{
+		{"exact copy", "prnewswire", "Acme launches widgets", dupText(widgets, boilerplate1), true},
+		{"changed boilerplate", "prweb", "Acme Ltd launches new widgets", dupText(widgets, boilerplate2), true},
+		{"unrelated", "acme", "Acme launches gadgets", dupText(gadgets, boilerplate1), false},
+		{"too short", "acme", "Acme launches widgets", "Widgets!", false},
+	}
+	for _, test := range tests {
+		id := stash(test.source, test.title, test.content)
+		ev, err := store.Fetch(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := id
+		if test.dup {
+			expected = orig
+		}
+		if ev.payload.DupGroup != expected {
+			t.Errorf("%s: got group %d, expected %d", test.name, ev.payload.DupGroup, expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package prscrape
+
+// Support for the scraper regression tests (see regress_test.go), which
+// live in prscrape_test so they can use the scrapers in ukscrapers.
+//
+// Each scraper's saved pages (fixtures) are kept in a cassette (see
+// cassette.go).
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// LoadScrapers builds the list of scrapers, as ServerMain does
+var LoadScrapers = loadScrapers
+
+// DiffLines returns the lines added and removed between a and b
+var DiffLines = diffLines
+
+// RegressSamples is the number of discovered press releases scraped for
+// each scraper
+var RegressSamples = 3
+
+// UseFixtures makes all requests go to the saved pages in dir (or, if
+// record is set, saves them there). Call the returned function to go back
+// to normal.
+func UseFixtures(dir string, record bool) (func(), error) {
+	if err := UseCassette(&Cassette{Dir: dir, Record: record}); err != nil {
+		return nil, err
+	}
+	return func() { UseCassette(nil) }, nil
+}
+
+// regressResults holds the results of running a scraper
+type regressResults struct {
+	Discovered    []string          `json:"discovered"`
+	DiscoverError string            `json:"discover_error,omitempty"`
+	Releases      []*regressRelease `json:"releases"`
+}
+
+// regressRelease is a scraped press release, as recorded in golden files
+type regressRelease struct {
+	Permalink string   `json:"permalink"`
+	URLs      []string `json:"urls"`
+	Title     string   `json:"title"`
+	// PubDate is nil if it had to be guessed (ie it's time-dependent)
+	PubDate  *time.Time `json:"published"`
+	Content  string     `json:"text"`
+	Error    string     `json:"error,omitempty"`
+	Problems []string   `json:"problems,omitempty"`
+}
+
+// RegressRun runs discovery, then scrapes the first few press releases,
+// returning the results as json
+func RegressRun(scraper *Scraper) ([]byte, error) {
+	res := &regressResults{Discovered: []string{}, Releases: []*regressRelease{}}
+	prs, err := scraper.Discover()
+	if err != nil {
+		res.DiscoverError = err.Error()
+		prs = nil
+	}
+	for _, pr := range prs {
+		res.Discovered = append(res.Discovered, pr.Permalink)
+	}
+	if len(prs) > RegressSamples {
+		prs = prs[:RegressSamples]
+	}
+	for _, pr := range prs {
+		if scraper.Scrape != nil {
+			if err := scrape(scraper, pr); err != nil {
+				res.Releases = append(res.Releases, &regressRelease{Permalink: pr.Permalink, URLs: pr.AllURLs(), Error: err.Error()})
+				continue
+			}
+		}
+		rr := &regressRelease{
+			Permalink: pr.Permalink,
+			URLs:      pr.AllURLs(),
+			Title:     pr.Title,
+			Content:   pr.Content,
+			Problems:  validationFor(scraper).Check(pr, time.Now()),
+		}
+		if !pr.pubDateFudged && !pr.PubDate.IsZero() {
+			t := pr.PubDate.UTC()
+			rr.PubDate = &t
+		}
+		res.Releases = append(res.Releases, rr)
+	}
+	out, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
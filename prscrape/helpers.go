@@ -6,13 +6,10 @@ import (
 	"code.google.com/p/go-charset/charset"
 	_ "code.google.com/p/go-charset/data"
 	"code.google.com/p/go.net/html"
-	"errors"
 	"fmt"
 	"github.com/bcampbell/fuzzytime"
 	rss "github.com/jteeuwen/go-pkg-rss"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -21,8 +18,15 @@ import (
 )
 
 // BuildGenericDiscover returns a DiscoverFunc which fetches a page and extracts matching links.
-// TODO: pageUrl should be an array
+// The page is fetched using DefaultFetcher.
 func BuildGenericDiscover(scraperName, pageUrl, linkSelector string, allowHostChange bool) (DiscoverFunc, error) {
+	return DefaultFetcher.BuildGenericDiscover(scraperName, pageUrl, linkSelector, allowHostChange)
+}
+
+// BuildGenericDiscover returns a DiscoverFunc which fetches a page and extracts matching links.
+// If the page hasn't changed since last time, it returns errNotModified.
+// TODO: pageUrl should be an array
+func (f *Fetcher) BuildGenericDiscover(scraperName, pageUrl, linkSelector string, allowHostChange bool) (DiscoverFunc, error) {
 	linkSel, err := cascadia.Compile(linkSelector)
 	if err != nil {
 		return nil, err
@@ -36,18 +40,30 @@ func BuildGenericDiscover(scraperName, pageUrl, linkSelector string, allowHostCh
 
 	return func() ([]*PressRelease, error) {
 
-		root, err := fetchPage(page)
+		fetched, err := f.fetchPageIfModified(page, scraperName)
 		if err != nil {
 			return nil, err
 		}
 
-		return getLinks(root, page, scraperName, linkSel, allowHostChange)
+		links, err := getLinks(fetched.Root, fetched.URL, scraperName, linkSel, allowHostChange)
+		if err != nil {
+			return nil, err
+		}
+		drift.Record(scraperName, "link_selector", linkSelector, len(links), len(links) > 0, fetched.URL.String())
+		return links, nil
 	}, nil
 }
 
 // BuildPaginatedGenericDiscover returns a DiscoverFunc which fetches links
 // and steps through multiple pages.
+// The pages are fetched using DefaultFetcher.
 func BuildPaginatedGenericDiscover(scraperName, startUrl, nextPageSelector, linkSelector string) (DiscoverFunc, error) {
+	return DefaultFetcher.BuildPaginatedGenericDiscover(scraperName, startUrl, nextPageSelector, linkSelector)
+}
+
+// BuildPaginatedGenericDiscover returns a DiscoverFunc which fetches links
+// and steps through multiple pages.
+func (f *Fetcher) BuildPaginatedGenericDiscover(scraperName, startUrl, nextPageSelector, linkSelector string) (DiscoverFunc, error) {
 	linkSel, err := cascadia.Compile(linkSelector)
 	if err != nil {
 		return nil, err
@@ -65,15 +81,18 @@ func BuildPaginatedGenericDiscover(scraperName, startUrl, nextPageSelector, link
 			return nil, err
 		}
 		for {
-			root, err := fetchPage(page)
+			fetched, err := f.fetchPage(page)
 			if err != nil {
 				return nil, err
 			}
+			root := fetched.Root
+			page = fetched.URL
 
 			foo, err := getLinks(root, page, scraperName, linkSel, true)
 			if err != nil {
 				return docs, err
 			}
+			drift.Record(scraperName, "link_selector", linkSelector, len(foo), len(foo) > 0, page.String())
 			docs = append(docs, foo...)
 
 			// more pages?
@@ -92,25 +111,40 @@ func BuildPaginatedGenericDiscover(scraperName, startUrl, nextPageSelector, link
 	}, nil
 }
 
+// fetchedPage holds the results of fetchPage
+type fetchedPage struct {
+	*fetchResult
+	Root *html.Node
+	// Canonical is the url given by <link rel="canonical">, if any
+	Canonical string
+}
+
+var canonicalSel = cascadia.MustCompile(`head link[rel="canonical"]`)
+
 // fetches an HTML page, converts it to utf-8 and parses it
-func fetchPage(page *url.URL) (*html.Node, error) {
-	resp, err := http.Get(page.String())
+func (f *Fetcher) fetchPage(page *url.URL) (*fetchedPage, error) {
+	resp, err := f.fetch(page)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: collect redirects
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err = errors.New(fmt.Sprintf("HTTP code %d (%s)", resp.StatusCode, page.String()))
-		return nil, err
-	}
+	return parsePage(resp)
+}
 
-	// read the page and devine the character encoding.
-	// if it's not utf-8, convert it.
-	rawHTML, err := ioutil.ReadAll(resp.Body)
+// fetchPageIfModified is like fetchPage, but returns errNotModified if the
+// page hasn't changed since it was last fetched.
+func (f *Fetcher) fetchPageIfModified(page *url.URL, scraperName string) (*fetchedPage, error) {
+	resp, err := f.fetchIfModified(page, scraperName)
 	if err != nil {
 		return nil, err
 	}
+	return parsePage(resp)
+}
+
+// parsePage converts a fetched HTML page to utf-8 and parses it
+func parsePage(resp *fetchResult) (*fetchedPage, error) {
+	// devine the character encoding.
+	// if it's not utf-8, convert it.
+	rawHTML := resp.Body
 
 	enc := findCharset("", rawHTML)
 	var r io.Reader
@@ -128,7 +162,32 @@ func fetchPage(page *url.URL) (*html.Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	return root, nil
+	fetched := &fetchedPage{fetchResult: resp, Root: root}
+	fetched.Canonical = findCanonical(root, fetched.URL)
+	return fetched, nil
+}
+
+// findCanonical looks for a usable <link rel="canonical"> url.
+// Returns "" if there isn't one.
+func findCanonical(root *html.Node, base *url.URL) string {
+	links := canonicalSel.MatchAll(root)
+	if len(links) == 0 {
+		return ""
+	}
+	canonical, err := base.Parse(strings.TrimSpace(GetAttr(links[0], "href")))
+	if err != nil {
+		return ""
+	}
+	if canonical.Scheme != "http" && canonical.Scheme != "https" {
+		return ""
+	}
+	// some sites (wrongly) use their front page as the canonical url of
+	// every page
+	if canonical.Path == "" || canonical.Path == "/" {
+		return ""
+	}
+	canonical.Fragment = ""
+	return canonical.String()
 }
 
 // getLinks grabs all links matching linkSel
@@ -156,6 +215,14 @@ func getLinks(root *html.Node, baseURL *url.URL, scraperName string, linkSel cas
 
 // BuildGenericScrape builds a function which scrapes a press release from raw_html based on a bunch of css selector strings
 func BuildGenericScrape(source, title, content, cruft, pubDate string) (ScrapeFunc, error) {
+	return BuildGenericScrapeWithEnds(source, title, content, cruft, pubDate, "", nil)
+}
+
+// BuildGenericScrapeWithEnds is like BuildGenericScrape, but the content
+// can be cut short at the first element matching endSel, or at the first
+// line of text matching any of the ends regexps (eg `\bENDS\b`,
+// "Notes to Editors"), to lose the trailing contact details and other cruft.
+func BuildGenericScrapeWithEnds(source, title, content, cruft, pubDate, endSel string, ends []string) (ScrapeFunc, error) {
 
 	// precompile all the selectors, to catch config errors early
 	titleSel, err := cascadia.Compile(title)
@@ -175,19 +242,47 @@ func BuildGenericScrape(source, title, content, cruft, pubDate string) (ScrapeFu
 		}
 	}
 
+	var endSelector cascadia.Selector = nil
+	if endSel != "" {
+		endSelector, err = cascadia.Compile(endSel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	endPats := make([]*regexp.Regexp, len(ends))
+	for i, end := range ends {
+		endPats[i], err = regexp.Compile(end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	urlDatePat := regexp.MustCompile(`/(\d{4})/(\d{2})/(\d{2})/`)
 	return func(pr *PressRelease, root *html.Node) (err error) {
 		pr.Type = "press release"
 		pr.Source = source
 
 		// title
-		pr.Title = CompressSpace(GetTextContent(titleSel.MatchAll(root)[0]))
+		// (how each selector gets on is tracked, to spot site changes -
+		// see drift.go)
+		titleEls := titleSel.MatchAll(root)
+		if len(titleEls) == 0 {
+			drift.Record(source, "title", title, 0, false, pr.Permalink)
+			return fmt.Errorf("title selector \"%s\" matched nothing", title)
+		}
+		pr.Title = CompressSpace(GetTextContent(titleEls[0]))
+		drift.Record(source, "title", title, len(titleEls), pr.Title != "", pr.Permalink)
 
 		// pubdate - only needs to contain a valid date string, doesn't matter
 		// if there's other crap in there too.
 		if pubDateSel != nil {
-			dateTxt := GetTextContent(pubDateSel.MatchAll(root)[0])
-			pr.PubDate, err = fuzzytime.Parse(dateTxt)
+			dateEls := pubDateSel.MatchAll(root)
+			if len(dateEls) == 0 {
+				drift.Record(source, "pubdate", pubDate, 0, false, pr.Permalink)
+				return fmt.Errorf("pubdate selector \"%s\" matched nothing", pubDate)
+			}
+			pr.PubDate, err = fuzzytime.Parse(GetTextContent(dateEls[0]))
+			drift.Record(source, "pubdate", pubDate, len(dateEls), err == nil && !pr.PubDate.IsZero(), pr.Permalink)
 			if err != nil {
 				return err
 			}
@@ -202,6 +297,7 @@ func BuildGenericScrape(source, title, content, cruft, pubDate string) (ScrapeFu
 			} else {
 				// last resort - just fudge using current time
 				pr.PubDate = time.Now()
+				pr.pubDateFudged = true
 			}
 		}
 
@@ -222,26 +318,54 @@ func BuildGenericScrape(source, title, content, cruft, pubDate string) (ScrapeFu
 		for _, el := range contentElements {
 			StripComments(el)
 
+			ended := false
+			if endSelector != nil {
+				ended = TruncateAt(el, endSelector)
+			}
 			txt := RenderText(el)
+			if pos := FindEnd(txt, endPats); pos >= 0 {
+				txt = txt[:pos]
+				ended = true
+			}
 			txt = regexp.MustCompile(`^[\n]{2,}`).ReplaceAllLiteralString(txt, "")
 			txt = regexp.MustCompile(`[\n]{2,}$`).ReplaceAllLiteralString(txt, "\n")
 			pr.Content += txt
+			if ended {
+				// skip any remaining content
+				break
+			}
 		}
+		drift.Record(source, "content", content, len(contentElements), strings.TrimSpace(pr.Content) != "", pr.Permalink)
 		return nil
 	}, nil
 }
 
 // BuildRSSDiscover returns a discover function which grabs links from rss feeds
+// The feeds are fetched using DefaultFetcher.
 func BuildRSSDiscover(scraperName string, feeds []string) (DiscoverFunc, error) {
+	return DefaultFetcher.BuildRSSDiscover(scraperName, feeds)
+}
+
+// BuildRSSDiscover returns a discover function which grabs links from rss feeds.
+// If none of the feeds have changed since last time, it returns errNotModified.
+func (f *Fetcher) BuildRSSDiscover(scraperName string, feeds []string) (DiscoverFunc, error) {
 	return func() ([]*PressRelease, error) {
 		docs := make([]*PressRelease, 0)
+		changed := false
 		for _, feed := range feeds {
-			foo, err := rssDiscover(scraperName, feed)
+			foo, err := f.rssDiscover(scraperName, feed)
+			if err == errNotModified {
+				continue
+			}
 			if err != nil {
 				return docs, err
 			}
+			changed = true
 			docs = append(docs, foo...)
 		}
+		if !changed && len(feeds) > 0 {
+			return docs, errNotModified
+		}
 		return docs, nil
 	}, nil
 }
@@ -255,12 +379,22 @@ func htmlToText(rawHTML string) string {
 	return RenderText(doc)
 }
 
-func rssDiscover(scraperName string, feedURL string) ([]*PressRelease, error) {
+func (f *Fetcher) rssDiscover(scraperName string, feedURL string) ([]*PressRelease, error) {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, fmt.Errorf("rss: %s", err)
+	}
+	resp, err := f.fetchIfModified(u, scraperName)
+	if err == errNotModified {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rss: %s", err)
+	}
+
 	feed := rss.New(0, false, nil, nil)
-	// TODO: ensure this DOES NOT go through an http proxy!
-	// (use FetchClient)
 	// TODO: this is a bit brittle with badly-formed XML (eg badly-encoded characters)
-	err := feed.Fetch(feedURL, nil)
+	err = feed.FetchBytes(feedURL, resp.Body, nil)
 	if err != nil {
 		return nil, fmt.Errorf("rss: %s", err)
 	}
@@ -318,7 +452,13 @@ func MustBuildGenericDiscover(scraperName, pageUrl, linkSelector string, allowHo
 
 // TODO: kill this once a proper config parser is in place
 func MustBuildGenericScrape(source, title, content, cruft, pubDate string) ScrapeFunc {
-	fn, err := BuildGenericScrape(source, title, content, cruft, pubDate)
+	return MustBuildGenericScrapeWithEnds(source, title, content, cruft, pubDate, "", nil)
+}
+
+// MustBuildGenericScrapeWithEnds is like BuildGenericScrapeWithEnds, but
+// panics on error
+func MustBuildGenericScrapeWithEnds(source, title, content, cruft, pubDate, endSel string, ends []string) ScrapeFunc {
+	fn, err := BuildGenericScrapeWithEnds(source, title, content, cruft, pubDate, endSel, ends)
 	if err != nil {
 		panic(err)
 	}
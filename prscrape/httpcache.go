@@ -0,0 +1,181 @@
+package prscrape
+
+// Conditional GET support for discovery.
+//
+// Index pages and feeds are polled every few minutes, but mostly don't
+// change between polls. We remember the ETag/Last-Modified validators
+// the server sent for each url, and send them back with the next request.
+// If the server answers "304 Not Modified", discovery skips that page, and
+// if nothing it looked at has changed the whole run is skipped (see doit).
+//
+// New validators aren't stored straight away - they're held until the links
+// found on the page have been dealt with. If any of those fail, the
+// validators are dropped, so the page is fetched in full next time around
+// and the failed links are retried.
+//
+// Individual press releases are always fetched in full.
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPCache stores the validators from previous responses
+type HTTPCache interface {
+	// GetValidators returns the ETag and Last-Modified values stored for a
+	// url, and when they were stored. Returns empty strings if none.
+	GetValidators(u string) (etag, lastModified string, stored time.Time, err error)
+	PutValidators(u, etag, lastModified string) error
+}
+
+// CacheMaxAge limits how long validators are used for. After that, the page
+// is fetched in full again regardless, so links which failed to scrape the
+// first time around will eventually be retried even if the page doesn't
+// change.
+var CacheMaxAge = 6 * time.Hour
+
+// errNotModified is returned when a page hasn't changed since last fetched
+var errNotModified = errors.New("not modified")
+
+// cacheStats counts conditional requests
+var cacheStats struct {
+	hits   int64
+	misses int64
+}
+
+// fetchIfModified is like fetch, but sends any stored validators for the
+// url. Returns errNotModified if the server says the page hasn't changed.
+// The new validators are held for the named scraper (see commitValidators).
+// Without a Cache (or with a cassette, which needs the full responses),
+// it's just a plain fetch.
+func (f *Fetcher) fetchIfModified(u *url.URL, scraperName string) (*fetchResult, error) {
+	if f.Cache == nil || currentCassette() != nil {
+		return f.fetch(u)
+	}
+	key := u.String()
+	hdr := http.Header{}
+	etag, lastModified, stored, err := f.Cache.GetValidators(key)
+	if err != nil {
+		glog.Errorf("http cache: %s", err)
+	} else if time.Since(stored) < CacheMaxAge {
+		if etag != "" {
+			hdr.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			hdr.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := f.fetchWithHeaders(u, hdr)
+	if err == errNotModified {
+		hits := atomic.AddInt64(&cacheStats.hits, 1)
+		if glog.V(1) {
+			glog.Infof("http cache: hit %s (%d hits, %d misses)", key, hits, atomic.LoadInt64(&cacheStats.misses))
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	misses := atomic.AddInt64(&cacheStats.misses, 1)
+	if glog.V(1) {
+		glog.Infof("http cache: miss %s (%d hits, %d misses)", key, atomic.LoadInt64(&cacheStats.hits), misses)
+	}
+
+	etag, lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" || lastModified != "" {
+		pending.hold(scraperName, &heldValidators{f.Cache, key, etag, lastModified})
+	}
+	return resp, nil
+}
+
+// heldValidators are validators waiting to be stored
+type heldValidators struct {
+	cache        HTTPCache
+	url          string
+	etag         string
+	lastModified string
+}
+
+// pending holds validators until the scraper's run is over.
+// scraper name => url => validators
+var pending = &pendingValidators{scrapers: make(map[string]map[string]*heldValidators)}
+
+type pendingValidators struct {
+	sync.Mutex
+	scrapers map[string]map[string]*heldValidators
+}
+
+func (p *pendingValidators) hold(scraperName string, v *heldValidators) {
+	p.Lock()
+	defer p.Unlock()
+	held, got := p.scrapers[scraperName]
+	if !got {
+		held = make(map[string]*heldValidators)
+		p.scrapers[scraperName] = held
+	}
+	held[v.url] = v
+}
+
+// commitValidators stores the validators held for a scraper, once the links
+// found have been dealt with. If ok isn't set (ie something failed), they're
+// thrown away instead, leaving the old ones in place.
+func commitValidators(scraperName string, ok bool) {
+	pending.Lock()
+	held := pending.scrapers[scraperName]
+	delete(pending.scrapers, scraperName)
+	pending.Unlock()
+	if !ok {
+		return
+	}
+	for _, v := range held {
+		if err := v.cache.PutValidators(v.url, v.etag, v.lastModified); err != nil {
+			glog.Errorf("http cache: %s", err)
+		}
+	}
+}
+
+// logCacheStats periodically logs the number of conditional requests which
+// were (and weren't) answered with "304 Not Modified".
+func logCacheStats(interval time.Duration) {
+	var lastHits, lastMisses int64
+	for _ = range time.Tick(interval) {
+		hits := atomic.LoadInt64(&cacheStats.hits)
+		misses := atomic.LoadInt64(&cacheStats.misses)
+		glog.Infof("http cache: %d hits, %d misses in last %s", hits-lastHits, misses-lastMisses, interval)
+		lastHits, lastMisses = hits, misses
+	}
+}
+
+// initHTTPCache sets up the table for storing validators
+func (store *DBStore) initHTTPCache() {
+	_, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS http_cache (
+         url TEXT PRIMARY KEY,
+         etag TEXT NOT NULL,
+         last_modified TEXT NOT NULL,
+         stored DATETIME NOT NULL )`)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetValidators implements HTTPCache
+func (store *DBStore) GetValidators(u string) (etag, lastModified string, stored time.Time, err error) {
+	err = store.db.QueryRow("SELECT etag,last_modified,stored FROM http_cache WHERE url=$1", u).Scan(&etag, &lastModified, &stored)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// PutValidators implements HTTPCache
+func (store *DBStore) PutValidators(u, etag, lastModified string) error {
+	_, err := store.db.Exec("INSERT OR REPLACE INTO http_cache (url,etag,last_modified,stored) VALUES ($1,$2,$3,$4)", u, etag, lastModified, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,287 @@
+package prscrape
+
+// Metrics, served at /metrics in the Prometheus text format:
+//   https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// We only need counters, gauges and histograms, so rather than pull in the
+// whole prometheus client library they're implemented here.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the metrics we collect
+var (
+	metricDiscoverRuns     = newCounter("ukpr_discover_runs_total", "Discovery runs, by source and result (ok, not_modified or error).", "source", "result")
+	metricDiscoverDuration = newHistogram("ukpr_discover_duration_seconds", "Time taken by discovery runs.", durationBuckets, "source")
+	metricDiscovered       = newCounter("ukpr_discovered_total", "Press releases found by discovery (new or not).", "source")
+	metricScrapes          = newCounter("ukpr_scrapes_total", "Press releases scraped, by source and result (ok or error).", "source", "result")
+	metricScrapeDuration   = newHistogram("ukpr_scrape_duration_seconds", "Time taken to fetch and scrape a press release.", durationBuckets, "source")
+	metricQuarantined      = newCounter("ukpr_quarantined_total", "Press releases which failed validation.", "source")
+	metricUpdated          = newCounter("ukpr_updated_total", "Stored press releases found to have changed when rechecked.", "source")
+	metricDrifted          = newCounter("ukpr_selector_drift_total", "Selectors which stopped matching (see drift.go), by source and role.", "source", "role")
+	metricStashErrors      = newCounter("ukpr_stash_errors_total", "Failures adding press releases to the store.", "source")
+	metricFetchDuration    = newHistogram("ukpr_fetch_duration_seconds", "Time taken by http requests.", durationBuckets, "host")
+	metricFetchResponses   = newCounter("ukpr_fetch_responses_total", "HTTP responses, by host and status code (\"error\" for failed requests).", "host", "code")
+	metricSSEClients       = newGauge("ukpr_sse_clients", "Connected SSE clients.", "channel")
+	metricEventsPublished  = newCounter("ukpr_events_published_total", "Events published to SSE clients.", "channel")
+)
+
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// metric is anything which can write itself out in the text format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var metrics struct {
+	sync.Mutex
+	all []metric
+}
+
+func registerMetric(m metric) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.all = append(metrics.all, m)
+}
+
+// serveMetrics is the handler for /metrics
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	metrics.Lock()
+	all := append([]metric(nil), metrics.all...)
+	metrics.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range all {
+		m.writeTo(w)
+	}
+}
+
+// metricVec is the common part of the metric types - a set of values, one
+// for each combination of label values.
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	typ    string
+	labels []string
+	values map[string]interface{}
+	// label values for each key in values
+	labelValues map[string][]string
+}
+
+func (v *metricVec) init(name, help, typ string, labels []string) {
+	v.name, v.help, v.typ, v.labels = name, help, typ, labels
+	v.values = make(map[string]interface{})
+	v.labelValues = make(map[string][]string)
+}
+
+// get returns the value for the given label values, creating it with
+// create() if need be. Must be called with the lock held.
+func (v *metricVec) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("%s: wrong number of label values", v.name))
+	}
+	key := strings.Join(labelValues, "\xff")
+	val, ok := v.values[key]
+	if !ok {
+		val = create()
+		v.values[key] = val
+		v.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	return val
+}
+
+// each calls fn for each value, in label order. Must be called with the
+// lock held.
+func (v *metricVec) each(fn func(labels string, val interface{})) {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(formatLabels(v.labels, v.labelValues[key]), v.values[key])
+	}
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// counterVec is a set of counters
+type counterVec struct {
+	metricVec
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{}
+	c.init(name, help, "counter", labels)
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(n float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	p := c.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*p += n
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.writeHeader(w)
+	c.each(func(labels string, val interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(*val.(*float64)))
+	})
+}
+
+// gaugeVec is a set of gauges
+type gaugeVec struct {
+	counterVec
+}
+
+func newGauge(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{}
+	g.init(name, help, "gauge", labels)
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeVec) Set(n float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	p := g.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*p = n
+}
+
+func (g *gaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// gaugeFunc is a single gauge whose value is fetched when needed
+type gaugeFunc struct {
+	metricVec
+	fn func() (float64, error)
+}
+
+func newGaugeFunc(name, help string, fn func() (float64, error)) *gaugeFunc {
+	g := &gaugeFunc{fn: fn}
+	g.init(name, help, "gauge", nil)
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	val, err := g.fn()
+	if err != nil {
+		// leave it out
+		return
+	}
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(val))
+}
+
+// histogramVec is a set of histograms
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{buckets: buckets}
+	h.init(name, help, "histogram", labels)
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) Observe(val float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	hist := h.get(labelValues, func() interface{} {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	}).(*histogram)
+	for i, upper := range h.buckets {
+		if val <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += val
+}
+
+// ObserveSince records the time elapsed since start
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.writeHeader(w)
+	h.each(func(labels string, val interface{}) {
+		hist := val.(*histogram)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, addLabel(labels, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, addLabel(labels, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+	})
+}
+
+// formatLabels gives eg `{source="tesco",result="ok"}`
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// addLabel adds an extra label to a formatted label set
+func addLabel(labels, name, value string) string {
+	extra := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+	return labels[:len(labels)-1] + "," + extra + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
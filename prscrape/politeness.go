@@ -0,0 +1,153 @@
+package prscrape
+
+// Politeness towards the sites we scrape.
+//
+// All requests to a host go through a shared hostState, whichever scraper
+// (or Fetcher) they come from, so that:
+//   - there's a minimum delay between the start of requests to the host
+//     (HostDelay, or the robots.txt Crawl-delay if longer)
+//   - no more than HostConcurrency requests are in flight to the host
+//   - urls disallowed by the host's robots.txt are skipped (unless the
+//     Fetcher has IgnoreRobots set)
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostDelay is the minimum time between starting requests to the same host
+var HostDelay = 1 * time.Second
+
+// HostConcurrency is the maximum number of requests in flight to the
+// same host
+var HostConcurrency = 2
+
+// RobotsTTL is how long a robots.txt file is used before being refetched
+var RobotsTTL = 24 * time.Hour
+
+// RobotsRetry is how soon to try again after failing to fetch a robots.txt
+// (server error or network trouble). Until then, the whole host is off
+// limits.
+var RobotsRetry = 10 * time.Minute
+
+// errRobots is returned when robots.txt disallows a url
+var errRobots = errors.New("disallowed by robots.txt")
+
+type hostState struct {
+	slots chan struct{}
+
+	sync.Mutex
+	next time.Time // earliest time the next request can start
+
+	robotsMu      sync.Mutex
+	robots        *robotsTxt
+	robotsExpires time.Time
+}
+
+var hosts = struct {
+	sync.Mutex
+	m map[string]*hostState
+}{m: make(map[string]*hostState)}
+
+func getHost(host string) *hostState {
+	hosts.Lock()
+	defer hosts.Unlock()
+	h, ok := hosts.m[host]
+	if !ok {
+		n := HostConcurrency
+		if n < 1 {
+			n = 1
+		}
+		h = &hostState{slots: make(chan struct{}, n)}
+		hosts.m[host] = h
+	}
+	return h
+}
+
+// acquire blocks until it's ok to make a request to the host.
+// Call release once the request is done.
+func (h *hostState) acquire(delay time.Duration) {
+	h.slots <- struct{}{}
+	h.Lock()
+	now := time.Now()
+	start := h.next
+	if start.Before(now) {
+		start = now
+	}
+	h.next = start.Add(delay)
+	h.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+func (h *hostState) release() {
+	<-h.slots
+}
+
+// crawlDelay returns the delay to use between requests by the given agent
+func (h *hostState) crawlDelay(agent string) time.Duration {
+	h.robotsMu.Lock()
+	defer h.robotsMu.Unlock()
+	delay := HostDelay
+	if h.robots != nil {
+		if d := h.robots.group(agent).crawlDelay; d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// allowed checks the url against the host's robots.txt, fetching it if
+// need be.
+func (f *Fetcher) allowed(h *hostState, u *url.URL) bool {
+	h.robotsMu.Lock()
+	defer h.robotsMu.Unlock()
+	if h.robots == nil || time.Now().After(h.robotsExpires) {
+		var ttl time.Duration
+		h.robots, ttl = f.fetchRobots(h, u)
+		h.robotsExpires = time.Now().Add(ttl)
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return h.robots.group(robotsAgent(f.UserAgent)).allowed(path)
+}
+
+// disallowAll is used for hosts whose robots.txt can't be fetched
+var disallowAll = parseRobots("User-agent: *\nDisallow: /\n")
+
+// fetchRobots grabs the robots.txt for the host of u, returning it along
+// with how long to use it for.
+// If there isn't one (a 4xx response), everything is allowed. If it can't
+// be fetched (a 5xx, or network trouble), nothing is, until it's retried.
+func (f *Fetcher) fetchRobots(h *hostState, u *url.URL) (*robotsTxt, time.Duration) {
+	robotsURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}
+	// (can't use the Crawl-delay yet - that's what we're fetching)
+	resp, err := f.getFrom(h, HostDelay, robotsURL, nil)
+	if err != nil {
+		if httpErr, ok := err.(*httpError); ok && httpErr.StatusCode < 500 && httpErr.StatusCode != http.StatusTooManyRequests {
+			return &robotsTxt{}, RobotsTTL
+		}
+		glog.Warningf("couldn't fetch %s (%s) - skipping %s for %s", robotsURL, err, u.Host, RobotsRetry)
+		return disallowAll, RobotsRetry
+	}
+	return parseRobots(string(resp.Body)), RobotsTTL
+}
+
+// robotsAgent returns the name to look for in robots.txt files, from
+// a user agent string (eg "ukpr (+https://...)" => "ukpr")
+func robotsAgent(userAgent string) string {
+	agent := strings.ToLower(strings.TrimSpace(userAgent))
+	if i := strings.IndexAny(agent, "/ "); i >= 0 {
+		agent = agent[:i]
+	}
+	return agent
+}
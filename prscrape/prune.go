@@ -0,0 +1,198 @@
+package prscrape
+
+// Pruning of old press releases.
+//
+// Press releases are kept for a retention period (measured from when they
+// were scraped), after which they are deleted. Sources can override the
+// default retention period. Quarantined press releases (discarded or not)
+// go the same way, measured from when they were quarantined.
+//
+// To give clients a chance to catch up after going down for a while, we
+// keep track of the last-event-ids clients have recently asked to resume
+// from, and never prune anything newer than those.
+//
+// The db uses incremental auto-vacuum, so the space freed can be handed
+// back bit by bit, rather than with a full VACUUM (which locks the whole
+// db while it rewrites it, and needs room for a second copy).
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// CursorGrace is how long we honour a client's last-event-id after we last
+// saw it.
+var CursorGrace = 48 * time.Hour
+
+// RetentionPolicy says how long press releases should be kept.
+// A zero duration means keep forever.
+type RetentionPolicy struct {
+	Default   time.Duration
+	PerSource map[string]time.Duration
+}
+
+// For returns the retention period for the given source
+func (policy *RetentionPolicy) For(source string) time.Duration {
+	if d, ok := policy.PerSource[source]; ok {
+		return d
+	}
+	return policy.Default
+}
+
+// cursorTracker remembers recently-used last-event-ids for each channel
+type cursorTracker struct {
+	sync.Mutex
+	seen map[string]map[int]time.Time
+}
+
+func newCursorTracker() *cursorTracker {
+	return &cursorTracker{seen: make(map[string]map[int]time.Time)}
+}
+
+// Touch notes that a client is interested in everything after id
+func (ct *cursorTracker) Touch(channel string, id int) {
+	ct.Lock()
+	defer ct.Unlock()
+	if _, ok := ct.seen[channel]; !ok {
+		ct.seen[channel] = make(map[int]time.Time)
+	}
+	ct.seen[channel][id] = time.Now()
+}
+
+// Oldest returns the lowest id still needed for channel, discarding any
+// which have expired. ok is false if there are none.
+func (ct *cursorTracker) Oldest(channel string, grace time.Duration) (oldest int, ok bool) {
+	ct.Lock()
+	defer ct.Unlock()
+	cutoff := time.Now().Add(-grace)
+	for id, t := range ct.seen[channel] {
+		if t.Before(cutoff) {
+			delete(ct.seen[channel], id)
+			continue
+		}
+		if !ok || id < oldest {
+			oldest = id
+			ok = true
+		}
+	}
+	return
+}
+
+// Prune deletes press releases (and quarantined ones) which have passed
+// their retention period.
+// Returns the number of press releases deleted.
+func (store *DBStore) Prune(policy *RetentionPolicy) (int64, error) {
+	rows, err := store.db.Query("SELECT source FROM press_release UNION SELECT source FROM quarantine")
+	if err != nil {
+		return 0, err
+	}
+	var sources []string
+	for rows.Next() {
+		var source string
+		if err := rows.Scan(&source); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sources = append(sources, source)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total, quarantined int64
+	for _, source := range sources {
+		retention := policy.For(source)
+		if retention <= 0 {
+			continue // keep forever
+		}
+		cutoff := time.Now().Add(-retention).UTC()
+
+		q := "DELETE FROM press_release WHERE source=$1 AND scraped<$2"
+		args := []interface{}{source, cutoff}
+		if oldest, ok := store.cursors.Oldest(source, CursorGrace); ok {
+			q += " AND id<=$3"
+			args = append(args, oldest)
+		}
+		res, err := store.db.Exec(q, args...)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		if n > 0 {
+			glog.Infof("%s: pruned %d press releases", source, n)
+		}
+		total += n
+
+		res, err = store.db.Exec("DELETE FROM quarantine WHERE source=$1 AND quarantined<$2", source, cutoff)
+		if err != nil {
+			return total, err
+		}
+		n, err = res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		if n > 0 {
+			glog.Infof("%s: pruned %d quarantined press releases", source, n)
+		}
+		quarantined += n
+	}
+
+	if total > 0 || quarantined > 0 {
+		// reclaim the space
+		if err := store.incrementalVacuum(); err != nil {
+			return total, err
+		}
+		if _, err := store.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// initAutoVacuum switches the db over to incremental auto-vacuum. An
+// existing db needs a one-off VACUUM to do that.
+func (store *DBStore) initAutoVacuum() {
+	var mode int
+	if err := store.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		panic(err)
+	}
+	if mode == 2 { // incremental
+		return
+	}
+	fmt.Printf("CONVERTING to incremental vacuum...")
+	// (has to be on the same connection as the VACUUM)
+	if _, err := store.db.Exec("PRAGMA auto_vacuum=INCREMENTAL; VACUUM"); err != nil {
+		panic(err)
+	}
+	fmt.Printf("done.\n")
+}
+
+// incrementalVacuum hands back the db's free pages
+func (store *DBStore) incrementalVacuum() error {
+	// each step frees a page, so it has to be run to the end
+	rows, err := store.db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+// RunPruner periodically prunes the store. Never returns.
+// policy is called each time, so the retention periods can change.
+func (store *DBStore) RunPruner(interval time.Duration, policy func() *RetentionPolicy) {
+	for {
+		if _, err := store.Prune(policy()); err != nil {
+			glog.Errorf("prune failed: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,369 @@
+package prscrape
+
+// Quarantine for press releases which fail validation.
+//
+// Quarantined press releases aren't stored or sent out to clients. They sit
+// in the quarantine table until someone takes a look, and either releases
+// them (optionally after fixing them up) or discards them.
+// Discarded ones are kept, so they don't just get scraped again (until
+// they're pruned, along with everything else - see prune.go).
+//
+// The page each one was scraped from is kept too (see raw.go), and goes
+// with it if it's released.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuarantinedRelease is a press release held in quarantine
+type QuarantinedRelease struct {
+	ID          int           `json:"id"`
+	Problems    []string      `json:"problems"`
+	Quarantined time.Time     `json:"quarantined"`
+	Discarded   bool          `json:"discarded"`
+	Release     *PressRelease `json:"release"`
+}
+
+// initQuarantine sets up the quarantine tables
+func (store *DBStore) initQuarantine() {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS quarantine (
+         id INTEGER PRIMARY KEY,
+         source TEXT NOT NULL,
+         data TEXT NOT NULL,
+         problems TEXT NOT NULL,
+         quarantined DATETIME NOT NULL,
+         discarded INTEGER NOT NULL DEFAULT 0 )`,
+		`CREATE TABLE IF NOT EXISTS quarantine_url (
+         id INTEGER PRIMARY KEY,
+         quarantine_id INTEGER NOT NULL,
+         url TEXT NOT NULL )`,
+		`CREATE INDEX IF NOT EXISTS quarantine_url_url ON quarantine_url(url)`,
+		`CREATE TRIGGER IF NOT EXISTS quarantine_url_del AFTER DELETE ON quarantine BEGIN
+           DELETE FROM quarantine_url WHERE quarantine_id=old.id;
+         END`,
+	}
+	for _, stmt := range stmts {
+		if _, err := store.db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// quarantined returns the id of the quarantined press release with the
+// given url (-1 if none)
+func (store *DBStore) quarantined(u, source string) (int64, error) {
+	var id int64
+	err := store.db.QueryRow("SELECT q.id FROM quarantine q JOIN quarantine_url u ON u.quarantine_id=q.id WHERE u.url=$1 AND q.source=$2", u, source).Scan(&id)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return id, err
+}
+
+// Quarantine puts a press release into quarantine.
+// If it's already there (under any of its urls) any new urls are just
+// added to the existing entry.
+func (store *DBStore) Quarantine(pr *PressRelease, problems []string) error {
+	pr.URLs = pr.AllURLs()
+
+	var id int64 = -1
+	var err error
+	for _, u := range pr.URLs {
+		if id, err = store.quarantined(u, pr.Source); err != nil {
+			return err
+		}
+		if id != -1 {
+			break
+		}
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if id == -1 {
+		data, err := json.Marshal(pr)
+		if err != nil {
+			return err
+		}
+		probs, err := json.Marshal(problems)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec("INSERT INTO quarantine (source,data,problems,quarantined) VALUES ($1,$2,$3,$4)", pr.Source, string(data), string(probs), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if err = putRawInto(tx, "quarantine_raw", "quarantine_id", id, pr.raw); err != nil {
+			return err
+		}
+	}
+	for _, u := range pr.URLs {
+		_, err = tx.Exec("INSERT INTO quarantine_url (quarantine_id,url) SELECT $1,$2 WHERE NOT EXISTS (SELECT 1 FROM quarantine_url WHERE quarantine_id=$1 AND url=$2)", id, u)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanQuarantined(row interface {
+	Scan(dest ...interface{}) error
+}) (*QuarantinedRelease, error) {
+	q := &QuarantinedRelease{}
+	var data, problems string
+	if err := row.Scan(&q.ID, &data, &problems, &q.Quarantined, &q.Discarded); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(data), &q.Release); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(problems), &q.Problems); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+const quarantineFields = "id,data,problems,quarantined,discarded"
+
+// QuarantineList returns the press releases in quarantine, oldest first.
+// source restricts the list to a single source ("" = all), and discarded
+// ones are only included if includeDiscarded is set.
+func (store *DBStore) QuarantineList(source string, includeDiscarded bool) ([]*QuarantinedRelease, error) {
+	where := []string{"1=1"}
+	args := []interface{}{}
+	if source != "" {
+		where = append(where, "source=?")
+		args = append(args, source)
+	}
+	if !includeDiscarded {
+		where = append(where, "discarded=0")
+	}
+	rows, err := store.db.Query("SELECT "+quarantineFields+" FROM quarantine WHERE "+strings.Join(where, " AND ")+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*QuarantinedRelease{}
+	for rows.Next() {
+		q, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+// QuarantineGet returns a single quarantined press release (nil if not found)
+func (store *DBStore) QuarantineGet(id int) (*QuarantinedRelease, error) {
+	q, err := scanQuarantined(store.db.QueryRow("SELECT "+quarantineFields+" FROM quarantine WHERE id=$1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return q, err
+}
+
+// QuarantineUpdate replaces a quarantined press release (eg after fixing
+// it up by hand), along with its list of problems
+func (store *DBStore) QuarantineUpdate(id int, pr *PressRelease, problems []string) error {
+	data, err := json.Marshal(pr)
+	if err != nil {
+		return err
+	}
+	probs, err := json.Marshal(problems)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec("UPDATE quarantine SET data=$1, problems=$2 WHERE id=$3", string(data), string(probs), id)
+	return err
+}
+
+// errStillProblems is returned when releasing a press release which still
+// fails validation
+var errStillProblems = errors.New("still has problems (fix them, or force the release)")
+
+// QuarantineRelease moves a press release out of quarantine and into the
+// store proper. Returns the new event, for publishing.
+// Unless force is set, it has to have been fixed up first.
+func (store *DBStore) QuarantineRelease(id int, force bool) (*pressReleaseEvent, error) {
+	q, err := store.QuarantineGet(id)
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		return nil, fmt.Errorf("quarantine %d not found", id)
+	}
+	if len(q.Problems) > 0 && !force {
+		return nil, errStillProblems
+	}
+	// take the snapshot along with it
+	if q.Release.raw, err = store.QuarantineRaw(id); err != nil {
+		return nil, err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ev, err := stash(tx, q.Release)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM quarantine WHERE id=$1", id); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// QuarantineDiscard marks a quarantined press release as unwanted. It stays
+// in the table so it won't be scraped again (but its snapshot goes).
+func (store *DBStore) QuarantineDiscard(id int) error {
+	res, err := store.db.Exec("UPDATE quarantine SET discarded=1 WHERE id=$1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("quarantine %d not found", id)
+	}
+	_, err = store.db.Exec("DELETE FROM quarantine_raw WHERE quarantine_id=$1", id)
+	return err
+}
+
+// quarantineMain handles the -quarantine commandline commands:
+//
+//	list [source ...]  - list quarantined press releases
+//	show <id>          - dump a quarantined press release as json
+//	fix <id>           - replace a quarantined press release with json
+//	                     read from stdin (eg edited output from show)
+//	release <id>       - move into the store proper (once fixed, or with -force)
+//	discard <id>       - mark as unwanted
+func quarantineMain(store *DBStore, scrapers []*Scraper, cmd string, args []string, force bool) error {
+	if cmd == "list" {
+		sources := args
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		for _, source := range sources {
+			qs, err := store.QuarantineList(source, false)
+			if err != nil {
+				return err
+			}
+			for _, q := range qs {
+				pr := q.Release
+				fmt.Printf("%d %s %s \"%s\"\n", q.ID, pr.Source, q.Quarantined.Format("2006-01-02"), pr.Title)
+				fmt.Printf("  %s\n", pr.Permalink)
+				fmt.Printf("  %s\n", strings.Join(q.Problems, "; "))
+			}
+		}
+		return nil
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("%s needs a quarantine id", cmd)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("bad id '%s'", args[0])
+	}
+	switch cmd {
+	case "show":
+		q, err := store.QuarantineGet(id)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("quarantine %d not found", id)
+		}
+		out, err := json.MarshalIndent(q, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case "fix":
+		q, err := store.QuarantineGet(id)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("quarantine %d not found", id)
+		}
+		var scraper *Scraper
+		for _, s := range scrapers {
+			if s.Name == q.Release.Source {
+				scraper = s
+			}
+		}
+		if err := q.fix(os.Stdin, validationFor(scraper)); err != nil {
+			return err
+		}
+		if err := store.QuarantineUpdate(id, q.Release, q.Problems); err != nil {
+			return err
+		}
+		fmt.Printf("%d: %s\n", id, strings.Join(q.Problems, "; "))
+	case "release":
+		ev, err := store.QuarantineRelease(id, force)
+		if err != nil {
+			return fmt.Errorf("%d: %s", id, err)
+		}
+		fmt.Printf("%d: released as %s\n", id, ev.Id())
+	case "discard":
+		if err := store.QuarantineDiscard(id); err != nil {
+			return err
+		}
+		fmt.Printf("%d: discarded\n", id)
+	default:
+		return fmt.Errorf("unknown quarantine command '%s'", cmd)
+	}
+	return nil
+}
+
+// fix updates the press release from json (either a press release, or a
+// QuarantinedRelease as output by "show"). Fields not in the json are left
+// alone. The problems are rechecked afterward, against rules.
+func (q *QuarantinedRelease) fix(r io.Reader, rules *ValidationRules) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var wrapped struct {
+		Release json.RawMessage `json:"release"`
+	}
+	if err := json.Unmarshal(raw, &wrapped); err == nil && wrapped.Release != nil {
+		raw = wrapped.Release
+	}
+	source := q.Release.Source
+	pubDate := q.Release.PubDate
+	if err := json.Unmarshal(raw, q.Release); err != nil {
+		return err
+	}
+	// no moving between sources
+	q.Release.Source = source
+	// a missing pubdate is still missing unless it's been changed
+	for _, problem := range q.Problems {
+		if problem == problemNoPubDate && q.Release.PubDate.Equal(pubDate) {
+			q.Release.pubDateFudged = true
+		}
+	}
+	q.Problems = rules.Check(q.Release, time.Now())
+	return nil
+}
@@ -0,0 +1,162 @@
+package prscrape
+
+// Raw snapshots of scraped pages.
+//
+// The page each press release was scraped from is kept (gzipped) along
+// with the response headers, so if a scraper turns out to have mangled
+// something, we can see what it was working from (and scrape it again).
+// Snapshots are deleted along with their press release.
+//
+// Quarantined press releases keep their snapshots in quarantine_raw, which
+// move across to press_release_raw if they're released.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// KeepRaw turns the storing of snapshots on or off
+var KeepRaw = true
+
+// RawPage is a snapshot of a fetched page
+type RawPage struct {
+	// URL is where the page came from (after any redirects)
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Fetched    time.Time   `json:"fetched"`
+	Body       []byte      `json:"-"`
+}
+
+func newRawPage(resp *fetchResult) *RawPage {
+	return &RawPage{
+		URL:        resp.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Fetched:    resp.Fetched.UTC(),
+		Body:       resp.Body,
+	}
+}
+
+// initRaw sets up the snapshot table
+func (store *DBStore) initRaw() {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS press_release_raw (
+         press_release_id INTEGER PRIMARY KEY,
+         url TEXT NOT NULL,
+         status INTEGER NOT NULL,
+         header TEXT NOT NULL,
+         fetched DATETIME NOT NULL,
+         body BLOB NOT NULL )`,
+		`CREATE TRIGGER IF NOT EXISTS press_release_raw_del AFTER DELETE ON press_release BEGIN
+           DELETE FROM press_release_raw WHERE press_release_id=old.id;
+         END`,
+		`CREATE TABLE IF NOT EXISTS quarantine_raw (
+         quarantine_id INTEGER PRIMARY KEY,
+         url TEXT NOT NULL,
+         status INTEGER NOT NULL,
+         header TEXT NOT NULL,
+         fetched DATETIME NOT NULL,
+         body BLOB NOT NULL )`,
+		`CREATE TRIGGER IF NOT EXISTS quarantine_raw_del AFTER DELETE ON quarantine BEGIN
+           DELETE FROM quarantine_raw WHERE quarantine_id=old.id;
+         END`,
+	}
+	for _, stmt := range stmts {
+		if _, err := store.db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// putRaw stores (or replaces) the snapshot for a press release
+func putRaw(tx *sql.Tx, id int64, raw *RawPage) error {
+	return putRawInto(tx, "press_release_raw", "press_release_id", id, raw)
+}
+
+// putRawInto stores (or replaces) a snapshot in the given table
+func putRawInto(tx *sql.Tx, table, idCol string, id int64, raw *RawPage) error {
+	if raw == nil || !KeepRaw {
+		return nil
+	}
+	hdr, err := json.Marshal(raw.Header)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw.Body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO "+table+" ("+idCol+",url,status,header,fetched,body) VALUES ($1,$2,$3,$4,$5,$6)",
+		id, raw.URL, raw.StatusCode, string(hdr), raw.Fetched, buf.Bytes())
+	return err
+}
+
+// Raw returns the snapshot of the page a press release was scraped from
+// (nil if there isn't one)
+func (store *DBStore) Raw(id int) (*RawPage, error) {
+	return store.rawFrom("press_release_raw", "press_release_id", id)
+}
+
+// QuarantineRaw returns the snapshot of the page a quarantined press
+// release was scraped from (nil if there isn't one)
+func (store *DBStore) QuarantineRaw(id int) (*RawPage, error) {
+	return store.rawFrom("quarantine_raw", "quarantine_id", id)
+}
+
+// rawFrom fetches a snapshot from the given table
+func (store *DBStore) rawFrom(table, idCol string, id int) (*RawPage, error) {
+	raw := &RawPage{}
+	var hdr string
+	var body []byte
+	err := store.db.QueryRow("SELECT url,status,header,fetched,body FROM "+table+" WHERE "+idCol+"=$1", id).Scan(&raw.URL, &raw.StatusCode, &hdr, &raw.Fetched, &body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(hdr), &raw.Header); err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("raw %d: %s", id, err)
+	}
+	defer r.Close()
+	if raw.Body, err = ioutil.ReadAll(r); err != nil {
+		return nil, fmt.Errorf("raw %d: %s", id, err)
+	}
+	return raw, nil
+}
+
+// serveRaw sends out a snapshot as it was originally served (or just the
+// details, as json, with ?format=json)
+func serveRaw(w http.ResponseWriter, req *http.Request, raw *RawPage) {
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(raw)
+		return
+	}
+	ct := raw.Header.Get("Content-Type")
+	if ct == "" {
+		ct = "text/html"
+	}
+	w.Header().Set("Content-Type", ct)
+	// it's someone else's page - don't let it run scripts as us
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Raw-URL", raw.URL)
+	w.Header().Set("X-Raw-Fetched", raw.Fetched.Format(time.RFC3339))
+	w.Write(raw.Body)
+}
@@ -0,0 +1,119 @@
+package prscrape_test
+
+// Regression tests for the scrapers.
+//
+// Each scraper can have a directory under testdata holding copies of the
+// pages it fetched (see fixtures_test.go), plus golden.json - the results
+// of running the scraper over them. The scrapers are rerun against their
+// saved pages (ie offline), and should give the same results, unless
+// something has broken:
+//
+//   go test ./prscrape -run Regress
+//
+// After changing a scraper on purpose, regenerate its golden file with:
+//
+//   go test ./prscrape -run Regress/asda -update
+//
+// Every scraper must have saved pages - a scraper without any fails,
+// except with -update, when the pages are fetched from the live site first.
+// So a new scraper should be committed along with its testdata directory.
+// To refresh a scraper's saved pages, delete its directory and -update.
+
+import (
+	"bytes"
+	"flag"
+	"github.com/bcampbell/ukpr/prscrape"
+	"github.com/bcampbell/ukpr/ukscrapers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files (fetching pages for scrapers without any)")
+
+// configure provides the coded scrapers, as per ukpr/main.go
+func configure(historical bool) []*prscrape.Scraper {
+	return []*prscrape.Scraper{
+		ukscrapers.NewTescoScraper(),
+	}
+}
+
+// scrapersUnderTest returns the real scrapers, plus the ones in
+// testdata/harness.json (which check the tests themselves)
+func scrapersUnderTest(t *testing.T) []*prscrape.Scraper {
+	scrapers, err := prscrape.LoadScrapers("../ukpr.json", configure, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := prscrape.LoadConfig("testdata/harness.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(scrapers, extra...)
+}
+
+func TestRegress(t *testing.T) {
+	for _, scraper := range scrapersUnderTest(t) {
+		scraper := scraper
+		t.Run(scraper.Name, func(t *testing.T) {
+			regress(t, scraper)
+		})
+	}
+}
+
+func regress(t *testing.T, scraper *prscrape.Scraper) {
+	dir := filepath.Join("testdata", scraper.Name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if !*update {
+			t.Fatalf("no saved pages in %s (use -update to fetch them)", dir)
+		}
+		// grab some from the live site
+		restore, err := prscrape.UseFixtures(dir, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = prscrape.RegressRun(scraper)
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved, _ := ioutil.ReadDir(dir); len(saved) == 0 {
+			os.Remove(dir)
+			t.Fatal("couldn't fetch anything from the live site")
+		}
+	}
+
+	restore, err := prscrape.UseFixtures(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restore()
+	got, err := prscrape.RegressRun(scraper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenFile := filepath.Join(dir, "golden.json")
+	if *update {
+		if err := ioutil.WriteFile(goldenFile, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, expected) {
+		return
+	}
+	added, removed := prscrape.DiffLines(strings.Split(string(expected), "\n"), strings.Split(string(got), "\n"))
+	for _, line := range removed {
+		t.Errorf("- %s", strings.TrimSpace(line))
+	}
+	for _, line := range added {
+		t.Errorf("+ %s", strings.TrimSpace(line))
+	}
+}
@@ -0,0 +1,212 @@
+package prscrape
+
+// Reprocessing of stored press releases.
+//
+// After fixing a broken scraper, the press releases it mangled can be
+// repaired by running the fixed scraper over the raw snapshots of their
+// pages (see raw.go), without having to fetch anything again.
+// The differences are shown, and can optionally be written back (as
+// revisions - see revisions.go).
+//
+// From the commandline:
+//   ukpr -reprocess [-since YYYY-MM-DD] [-until YYYY-MM-DD] [-write] source ...
+// or, to send update events out to connected clients, on the running
+// server:
+//   curl -X POST 'http://localhost:9999/admin/reprocess?source=&since=&until=&write=1'
+
+import (
+	"fmt"
+	"github.com/donovanhide/eventsource"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ReprocessStats holds the results of reprocessing a source
+type ReprocessStats struct {
+	// Checked is the number of press releases looked at
+	Checked int
+	// NoRaw is the number without a snapshot to work from
+	NoRaw int
+	// Failed is the number the scraper failed on
+	Failed int
+	// Changed is the number which came out differently, and Written the
+	// number of those stored
+	Changed int
+	Written int
+}
+
+// reprocess reruns the scraper over the stored snapshots of the press
+// releases matching q, writing the differences to out. If write is set,
+// the changes are stored, and published via sseSrv (if not nil).
+func reprocess(scraper *Scraper, store *DBStore, q ReleaseQuery, write bool, sseSrv *eventsource.Server, out io.Writer) (*ReprocessStats, error) {
+	if scraper.Scrape == nil {
+		return nil, fmt.Errorf("%s: nothing to reprocess (no scrape step)", scraper.Name)
+	}
+	stats := &ReprocessStats{}
+	q.Source = scraper.Name
+	q.ByScraped = true
+	q.Limit = 100
+	for {
+		evs, err := store.Query(&q)
+		if err != nil {
+			return stats, err
+		}
+		for _, old := range evs {
+			stats.Checked++
+			raw, err := store.Raw(old.id)
+			if err != nil {
+				return stats, err
+			}
+			if raw == nil {
+				stats.NoRaw++
+				continue
+			}
+			pr, err := rescrape(scraper, old.payload, raw)
+			if err != nil {
+				stats.Failed++
+				fmt.Fprintf(out, "%d %s FAILED: %s\n", old.id, old.payload.Permalink, err)
+				continue
+			}
+			changes := diffReleases(old.payload, pr)
+			if changes == nil {
+				continue
+			}
+			stats.Changed++
+			writeChanges(out, old, changes, pr)
+			if write && revise(scraper, store, sseSrv, old, pr, changes) {
+				stats.Written++
+			}
+		}
+		if len(evs) < q.Limit {
+			break
+		}
+		q.After = evs[len(evs)-1].id
+	}
+	return stats, nil
+}
+
+// rescrape runs the scraper over a snapshot, returning the new version
+// of the press release
+func rescrape(scraper *Scraper, stored *PressRelease, raw *RawPage) (*PressRelease, error) {
+	u, err := url.Parse(raw.URL)
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := parsePage(&fetchResult{
+		URL:        u,
+		StatusCode: raw.StatusCode,
+		Header:     raw.Header,
+		Body:       raw.Body,
+		Fetched:    raw.Fetched,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// start from the stored version, as per recheck()
+	pr := *stored
+	pr.URLs = append([]string(nil), stored.URLs...)
+	if err := scrapePage(scraper, &pr, fetched); err != nil {
+		return nil, err
+	}
+	// the snapshot is unchanged
+	pr.raw = nil
+	return &pr, nil
+}
+
+// writeChanges describes the differences between two versions of a press
+// release
+func writeChanges(out io.Writer, old *pressReleaseEvent, changes *ReleaseChanges, pr *PressRelease) {
+	fmt.Fprintf(out, "%d %s (%s)\n", old.id, old.payload.Permalink, strings.Join(changes.Fields, ", "))
+	for _, field := range changes.Fields {
+		switch field {
+		case "title":
+			fmt.Fprintf(out, "  title: \"%s\" => \"%s\"\n", old.payload.Title, pr.Title)
+		case "published":
+			fmt.Fprintf(out, "  published: %s => %s\n", old.payload.PubDate.Format(time.RFC3339), pr.PubDate.Format(time.RFC3339))
+		}
+	}
+	if changes.LinesAdded > 0 || changes.LinesRemoved > 0 {
+		fmt.Fprintf(out, "  text: %d lines added, %d removed\n", changes.LinesAdded, changes.LinesRemoved)
+		for _, line := range changes.Removed {
+			fmt.Fprintf(out, "  - %s\n", line)
+		}
+		if changes.LinesRemoved > len(changes.Removed) {
+			fmt.Fprintf(out, "  - ...\n")
+		}
+		for _, line := range changes.Added {
+			fmt.Fprintf(out, "  + %s\n", line)
+		}
+		if changes.LinesAdded > len(changes.Added) {
+			fmt.Fprintf(out, "  + ...\n")
+		}
+	}
+}
+
+func writeReprocessStats(out io.Writer, name string, stats *ReprocessStats, write bool) {
+	fmt.Fprintf(out, "%s: %d checked, %d without snapshots, %d failed, %d changed", name, stats.Checked, stats.NoRaw, stats.Failed, stats.Changed)
+	if write {
+		fmt.Fprintf(out, ", %d written", stats.Written)
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+// reprocessMain handles the -reprocess commandline mode.
+// Changes written back aren't published (there's no server running) -
+// use /admin/reprocess on the server for that.
+func reprocessMain(store *DBStore, scrapers []*Scraper, sources []string, since, until time.Time, write bool, out io.Writer) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("-reprocess needs at least one source")
+	}
+	byName := make(map[string]*Scraper)
+	for _, scraper := range scrapers {
+		byName[scraper.Name] = scraper
+	}
+	for _, source := range sources {
+		scraper, ok := byName[source]
+		if !ok {
+			return fmt.Errorf("unknown source '%s'", source)
+		}
+		stats, err := reprocess(scraper, store, ReleaseQuery{Since: since, Until: until}, write, nil, out)
+		if err != nil {
+			return err
+		}
+		writeReprocessStats(out, source, stats, write)
+	}
+	return nil
+}
+
+// reprocessHandler handles POSTs to /admin/reprocess on the server (where
+// update events can be sent out to clients)
+func reprocessHandler(store *DBStore, scrapers *scraperSet, sseSrv *eventsource.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		params := req.URL.Query()
+		source := params.Get("source")
+		scraper := scrapers.Get(source)
+		if scraper == nil {
+			http.Error(w, fmt.Sprintf("unknown source '%s'", source), http.StatusBadRequest)
+			return
+		}
+		var q ReleaseQuery
+		limit := 0
+		if bad := parseCommonParams(params, &q.Since, &q.Until, &limit); bad != "" {
+			http.Error(w, "bad "+bad, http.StatusBadRequest)
+			return
+		}
+		write := params.Get("write") == "1"
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		stats, err := reprocess(scraper, store, q, write, sseSrv, w)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return
+		}
+		writeReprocessStats(w, source, stats, write)
+	}
+}
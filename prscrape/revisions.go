@@ -0,0 +1,402 @@
+package prscrape
+
+// Rechecking of recently stored press releases.
+//
+// Press releases often change after they first go out (corrections,
+// embargo times added, quotes rewritten...). For a while after they're
+// stored (the recheck window), press releases are scraped again every
+// RecheckInterval. If anything has changed, the old version is kept as a
+// revision, the stored press release is updated, and a
+// "press_release_updated" event is sent out to clients, with a summary of
+// the changes.
+//
+// Update events have no id, so they don't disturb clients' last-event-ids,
+// and they aren't replayed. Clients which miss them can get the earlier
+// versions via /api/releases/<id>/revisions.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donovanhide/eventsource"
+	"github.com/golang/glog"
+	"strings"
+	"time"
+)
+
+// RecheckWindow is how long after being stored press releases are
+// rechecked, for scrapers which don't set their own (0 = never)
+var RecheckWindow time.Duration
+
+// RecheckInterval is how often each press release in the window is
+// rechecked
+var RecheckInterval = 6 * time.Hour
+
+// RecheckBatch is the most press releases to recheck in a single run of
+// a scraper
+var RecheckBatch = 20
+
+// maxDiffLines is the most added (or removed) lines to include in a
+// change summary
+const maxDiffLines = 10
+
+// maxDiffCells limits the size of the table used to diff content
+const maxDiffCells = 4000000
+
+// Revision is an earlier version of a press release
+type Revision struct {
+	// Version counts from 1 (the version originally scraped)
+	Version int `json:"version"`
+	// Replaced is when it was superseded by the next version
+	Replaced time.Time `json:"replaced"`
+	Title    string    `json:"title"`
+	PubDate  time.Time `json:"published"`
+	Content  string    `json:"text"`
+}
+
+// ReleaseChanges summarises the differences between two versions of a
+// press release
+type ReleaseChanges struct {
+	// Fields lists what changed, out of "title", "published" and "text"
+	Fields     []string   `json:"fields"`
+	OldTitle   string     `json:"old_title,omitempty"`
+	OldPubDate *time.Time `json:"old_published,omitempty"`
+	// number of lines of text added and removed, along with (some of)
+	// the lines themselves
+	LinesAdded   int      `json:"lines_added"`
+	LinesRemoved int      `json:"lines_removed"`
+	Added        []string `json:"added,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+}
+
+// revisionStore is implemented by stores which can recheck press releases
+type revisionStore interface {
+	DueForRecheck(source string, window time.Duration, limit int) ([]*pressReleaseEvent, error)
+	MarkChecked(id int) error
+	Revise(id int, pr *PressRelease) (int, error)
+}
+
+// pressReleaseUpdatedEvent is sent out when a stored press release changes
+type pressReleaseUpdatedEvent struct {
+	payload *PressRelease
+	id      int
+	version int
+	changes *ReleaseChanges
+}
+
+func (ev *pressReleaseUpdatedEvent) Id() string {
+	// no id - see above
+	return ""
+}
+
+func (ev *pressReleaseUpdatedEvent) Event() string {
+	return "press_release_updated"
+}
+
+func (ev *pressReleaseUpdatedEvent) Data() string {
+	out, err := json.Marshal(struct {
+		ID           int             `json:"id"`
+		Version      int             `json:"version"`
+		PressRelease *PressRelease   `json:"press_release"`
+		Changes      *ReleaseChanges `json:"changes"`
+	}{ev.id, ev.version, ev.payload, ev.changes})
+	if err != nil {
+		panic(err)
+	}
+	return string(out)
+}
+
+// initRevisions sets up the revision table, and the column recording
+// when each press release was last rechecked
+func (store *DBStore) initRevisions() {
+	if !store.hasColumn("press_release", "checked") {
+		fmt.Printf("ADDING checked column...")
+		if _, err := store.db.Exec("ALTER TABLE press_release ADD COLUMN checked DATETIME"); err != nil {
+			panic(err)
+		}
+		fmt.Printf("done.\n")
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS press_release_revision (
+         id INTEGER PRIMARY KEY,
+         press_release_id INTEGER NOT NULL,
+         title TEXT NOT NULL,
+         pubdate DATETIME NOT NULL,
+         content TEXT NOT NULL,
+         replaced DATETIME NOT NULL )`,
+		`CREATE INDEX IF NOT EXISTS press_release_revision_pr ON press_release_revision(press_release_id)`,
+		`CREATE TRIGGER IF NOT EXISTS press_release_revision_del AFTER DELETE ON press_release BEGIN
+           DELETE FROM press_release_revision WHERE press_release_id=old.id;
+         END`,
+	}
+	for _, stmt := range stmts {
+		if _, err := store.db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// DueForRecheck returns press releases from source which were stored
+// within window, and haven't been checked for RecheckInterval.
+// Those waiting longest come first.
+func (store *DBStore) DueForRecheck(source string, window time.Duration, limit int) ([]*pressReleaseEvent, error) {
+	now := time.Now().UTC()
+	rows, err := store.db.Query("SELECT "+prFields+" FROM press_release WHERE source=$1 AND scraped>=$2 AND COALESCE(checked,scraped)<$3 ORDER BY COALESCE(checked,scraped) LIMIT $4",
+		source, now.Add(-window), now.Add(-RecheckInterval), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*pressReleaseEvent{}
+	for rows.Next() {
+		ev, err := scanPressRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// MarkChecked records that a press release has just been rechecked
+func (store *DBStore) MarkChecked(id int) error {
+	_, err := store.db.Exec("UPDATE press_release SET checked=$1 WHERE id=$2", time.Now().UTC(), id)
+	return err
+}
+
+// Revise replaces the title, pubdate and content of a stored press
+// release, keeping the old version as a revision. The raw snapshot is
+// replaced too, if pr has one. Returns the new version number.
+func (store *DBStore) Revise(id int, pr *PressRelease) (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO press_release_revision (press_release_id,title,pubdate,content,replaced) SELECT id,title,pubdate,content,$1 FROM press_release WHERE id=$2", now, id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE press_release SET title=$1, pubdate=$2, content=$3, checked=$4 WHERE id=$5", pr.Title, pr.PubDate, pr.Content, now, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = refingerprint(tx, int64(id), newFingerprint(pr)); err != nil {
+		return 0, err
+	}
+	if err = putRaw(tx, int64(id), pr.raw); err != nil {
+		return 0, err
+	}
+	var cnt int
+	err = tx.QueryRow("SELECT COUNT(*) FROM press_release_revision WHERE press_release_id=$1", id).Scan(&cnt)
+	if err != nil {
+		return 0, err
+	}
+	return cnt + 1, tx.Commit()
+}
+
+// Revisions returns the earlier versions of a press release, oldest first
+func (store *DBStore) Revisions(id int) ([]*Revision, error) {
+	rows, err := store.db.Query("SELECT title,pubdate,content,replaced FROM press_release_revision WHERE press_release_id=$1 ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*Revision{}
+	for rows.Next() {
+		rev := &Revision{Version: len(out) + 1}
+		if err := rows.Scan(&rev.Title, &rev.PubDate, &rev.Content, &rev.Replaced); err != nil {
+			return nil, err
+		}
+		out = append(out, rev)
+	}
+	return out, rows.Err()
+}
+
+// recheckWindow returns the recheck window to use for a scraper
+func recheckWindow(scraper *Scraper) time.Duration {
+	if scraper.Recheck != 0 {
+		return scraper.Recheck
+	}
+	return RecheckWindow
+}
+
+// recheck scrapes any press releases which are due another look, storing
+// and publishing any changes.
+func recheck(scraper *Scraper, store revisionStore, sseSrv *eventsource.Server, stats *RunStats) {
+	window := recheckWindow(scraper)
+	if window <= 0 || scraper.Scrape == nil {
+		return
+	}
+	due, err := store.DueForRecheck(scraper.Name, window, RecheckBatch)
+	if err != nil {
+		glog.Errorf("%s: recheck failed: %s", scraper.Name, err)
+		return
+	}
+	for _, old := range due {
+		stats.Rechecked++
+		// start from the stored version, in case the scraper relies on
+		// anything filled in by discovery
+		pr := *old.payload
+		pr.URLs = append([]string(nil), old.payload.URLs...)
+		if err := scrape(scraper, &pr); err != nil {
+			// might be gone, might just be down - try again next time
+			if glog.V(1) {
+				glog.Infof("%s: recheck %s: %s", scraper.Name, old.payload.Permalink, err)
+			}
+		} else if changes := diffReleases(old.payload, &pr); changes != nil {
+			if revise(scraper, store, sseSrv, old, &pr, changes) {
+				stats.Updated++
+				continue
+			}
+		}
+		if err := store.MarkChecked(old.id); err != nil {
+			glog.Errorf("%s: recheck %s: %s", scraper.Name, old.payload.Permalink, err)
+		}
+	}
+}
+
+// revise stores a changed version of a press release, and tells any
+// connected clients. Returns false if the changes weren't stored.
+func revise(scraper *Scraper, store revisionStore, sseSrv *eventsource.Server, old *pressReleaseEvent, pr *PressRelease, changes *ReleaseChanges) bool {
+	// don't let a broken page replace a good press release
+	if problems := validationFor(scraper).Check(pr, time.Now()); len(problems) > 0 {
+		glog.Warningf("%s: ignoring changes to %s (%s)", scraper.Name, pr.Permalink, strings.Join(problems, "; "))
+		return false
+	}
+	version, err := store.Revise(old.id, pr)
+	if err != nil {
+		glog.Errorf("%s: failed to revise %s (%s)", scraper.Name, pr.Permalink, err)
+		return false
+	}
+	metricUpdated.Inc(scraper.Name)
+	glog.Infof("%s: updated %s (%s)", scraper.Name, pr.Permalink, strings.Join(changes.Fields, ", "))
+
+	if sseSrv != nil {
+		sseSrv.Publish([]string{pr.Source}, &pressReleaseUpdatedEvent{pr, old.id, version, changes})
+		metricEventsPublished.Inc(pr.Source)
+	}
+	return true
+}
+
+// diffReleases compares a freshly-scraped press release with the stored
+// version. Returns nil if nothing has changed.
+// Only the title, pubdate and text are compared. The rest of new is reset
+// to match the stored version.
+func diffReleases(old, new *PressRelease) *ReleaseChanges {
+	// the stored copy is the one clients know about
+	new.Permalink, new.URLs, new.DupGroup = old.Permalink, old.URLs, old.DupGroup
+	if new.pubDateFudged {
+		// no date on the page (any more) - not a change
+		new.PubDate, new.pubDateFudged = old.PubDate, false
+	}
+
+	changes := &ReleaseChanges{Fields: []string{}}
+	if strings.TrimSpace(new.Title) != strings.TrimSpace(old.Title) {
+		changes.Fields = append(changes.Fields, "title")
+		changes.OldTitle = old.Title
+	}
+	if !new.PubDate.Equal(old.PubDate) {
+		changes.Fields = append(changes.Fields, "published")
+		t := old.PubDate
+		changes.OldPubDate = &t
+	}
+	added, removed := diffLines(contentLines(old.Content), contentLines(new.Content))
+	if len(added) > 0 || len(removed) > 0 {
+		changes.Fields = append(changes.Fields, "text")
+		changes.LinesAdded, changes.LinesRemoved = len(added), len(removed)
+		if len(added) > maxDiffLines {
+			added = added[:maxDiffLines]
+		}
+		if len(removed) > maxDiffLines {
+			removed = removed[:maxDiffLines]
+		}
+		changes.Added, changes.Removed = added, removed
+	}
+	if len(changes.Fields) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// contentLines splits text into lines for comparing, ignoring whitespace
+// differences and blank lines
+func contentLines(txt string) []string {
+	out := []string{}
+	for _, line := range strings.Split(txt, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// diffLines compares two lists of lines, returning the lines added and
+// removed (in order).
+func diffLines(a, b []string) (added, removed []string) {
+	// strip the common ends (usually most of it)
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	if len(a)*len(b) > maxDiffCells {
+		// too big to diff properly - just compare as sets of lines
+		count := make(map[string]int)
+		for _, line := range a {
+			count[line]++
+		}
+		for _, line := range b {
+			if count[line] > 0 {
+				count[line]--
+			} else {
+				added = append(added, line)
+			}
+		}
+		for _, line := range a {
+			if count[line] > 0 {
+				count[line]--
+				removed = append(removed, line)
+			}
+		}
+		return
+	}
+
+	// longest common subsequence
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	removed = append(removed, a[i:]...)
+	added = append(added, b[j:]...)
+	return
+}
@@ -0,0 +1,161 @@
+package prscrape
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameLines compares line lists, treating nil and empty as the same
+func sameLines(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		added   []string
+		removed []string
+	}{
+		{"same", "a b c", "a b c", nil, nil},
+		{"changed", "a b c", "a B c", []string{"B"}, []string{"b"}},
+		{"inserted", "a c", "a b c", []string{"b"}, nil},
+		{"deleted", "a b c", "a c", nil, []string{"b"}},
+		{"appended", "a", "a b c", []string{"b", "c"}, nil},
+		{"from nothing", "", "a b", []string{"a", "b"}, nil},
+		{"to nothing", "a b", "", nil, []string{"a", "b"}},
+		{"moved", "a b c", "c a b", []string{"c"}, []string{"c"}},
+		{"repeated line", "a x a", "a a", nil, []string{"x"}},
+		{"several", "a b c d e f", "a c d E f g", []string{"E", "g"}, []string{"b", "e"}},
+	}
+	for _, test := range tests {
+		added, removed := diffLines(strings.Fields(test.a), strings.Fields(test.b))
+		if !sameLines(added, test.added) || !sameLines(removed, test.removed) {
+			t.Errorf("%s: got +%q -%q, expected +%q -%q", test.name, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// enough lines between the differing ends to go over maxDiffCells
+	var middle []string
+	for i := 0; i*i <= maxDiffCells; i++ {
+		middle = append(middle, fmt.Sprintf("line %d", i))
+	}
+	lines := func(first string, last ...string) []string {
+		return append(append([]string{first}, middle...), last...)
+	}
+
+	tests := []struct {
+		name    string
+		a, b    []string
+		added   []string
+		removed []string
+	}{
+		// compared as sets, so moves don't show up
+		{"moved", lines("x", "y"), lines("y", "x"), nil, nil},
+		{"changed", lines("x", "y", "old"), lines("y", "x", "new"), []string{"new"}, []string{"old"}},
+		{"repeated line", lines("x", "x", "x"), lines("y", "x"), []string{"y"}, []string{"x", "x"}},
+		// common ends are stripped first, so this is still a proper diff
+		{"small change", lines("x", "old"), lines("x", "new"), []string{"new"}, []string{"old"}},
+	}
+	for _, test := range tests {
+		added, removed := diffLines(test.a, test.b)
+		if !sameLines(added, test.added) || !sameLines(removed, test.removed) {
+			t.Errorf("%s: got +%q -%q, expected +%q -%q", test.name, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestDiffReleases(t *testing.T) {
+	when := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := &PressRelease{
+		Title:     "Acme launches widgets",
+		Permalink: "http://acme.example/widgets",
+		URLs:      []string{"http://acme.example/widgets", "http://acme.example/?p=1"},
+		PubDate:   when,
+		Content:   "Acme has launched widgets.\n\nThey are very good.\n\nAbout Acme: Acme makes widgets.",
+		DupGroup:  42,
+	}
+	var many []string
+	for i := 0; i < maxDiffLines+5; i++ {
+		many = append(many, fmt.Sprintf("Widget %d is very good.", i))
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(pr *PressRelease)
+		fields   []string // nil for no changes
+		added    int
+		removed  int
+		oldTitle string
+		oldDate  bool
+	}{
+		{"unchanged", func(pr *PressRelease) {}, nil, 0, 0, "", false},
+		{"whitespace", func(pr *PressRelease) {
+			pr.Title = " " + pr.Title + "\n"
+			pr.Content = strings.Replace(pr.Content, "\n\n", "\n  \n\n", -1)
+		}, nil, 0, 0, "", false},
+		{"moved", func(pr *PressRelease) { pr.Permalink = "http://acme.example/new/widgets" }, nil, 0, 0, "", false},
+		{"fudged date", func(pr *PressRelease) { pr.PubDate, pr.pubDateFudged = time.Now(), true }, nil, 0, 0, "", false},
+		{"title", func(pr *PressRelease) { pr.Title = "Acme launches better widgets" },
+			[]string{"title"}, 0, 0, "Acme launches widgets", false},
+		{"published", func(pr *PressRelease) { pr.PubDate = when.Add(time.Hour) },
+			[]string{"published"}, 0, 0, "", true},
+		{"text", func(pr *PressRelease) { pr.Content = strings.Replace(pr.Content, "very good", "excellent", 1) },
+			[]string{"text"}, 1, 1, "", false},
+		{"everything", func(pr *PressRelease) {
+			pr.Title = "Acme recalls widgets"
+			pr.PubDate = when.AddDate(0, 0, 1)
+			pr.Content += "\n\nUPDATE: widgets recalled."
+		}, []string{"title", "published", "text"}, 1, 0, "Acme launches widgets", true},
+		{"lots of text", func(pr *PressRelease) { pr.Content += "\n" + strings.Join(many, "\n") },
+			[]string{"text"}, maxDiffLines + 5, 0, "", false},
+	}
+	for _, test := range tests {
+		pr := *old
+		test.modify(&pr)
+		changes := diffReleases(old, &pr)
+
+		// the stored identity always wins
+		if pr.Permalink != old.Permalink || !reflect.DeepEqual(pr.URLs, old.URLs) || pr.DupGroup != old.DupGroup || pr.pubDateFudged {
+			t.Errorf("%s: new version not reset to match the stored one", test.name)
+		}
+		if test.fields == nil {
+			if changes != nil {
+				t.Errorf("%s: got changes %v, expected none", test.name, changes.Fields)
+			}
+			if !pr.PubDate.Equal(old.PubDate) {
+				t.Errorf("%s: got pubdate %s, expected %s", test.name, pr.PubDate, old.PubDate)
+			}
+			continue
+		}
+		if changes == nil {
+			t.Errorf("%s: got no changes, expected %v", test.name, test.fields)
+			continue
+		}
+		if !reflect.DeepEqual(changes.Fields, test.fields) {
+			t.Errorf("%s: got fields %v, expected %v", test.name, changes.Fields, test.fields)
+		}
+		if changes.LinesAdded != test.added || changes.LinesRemoved != test.removed {
+			t.Errorf("%s: got +%d -%d lines, expected +%d -%d", test.name, changes.LinesAdded, changes.LinesRemoved, test.added, test.removed)
+		}
+		if len(changes.Added) > maxDiffLines || len(changes.Removed) > maxDiffLines {
+			t.Errorf("%s: got %d/%d lines in the summary, expected at most %d", test.name, len(changes.Added), len(changes.Removed), maxDiffLines)
+		}
+		if changes.OldTitle != test.oldTitle {
+			t.Errorf("%s: got old title %q, expected %q", test.name, changes.OldTitle, test.oldTitle)
+		}
+		if got := changes.OldPubDate != nil; got != test.oldDate {
+			t.Errorf("%s: got old pubdate %t, expected %t", test.name, got, test.oldDate)
+		} else if got && !changes.OldPubDate.Equal(when) {
+			t.Errorf("%s: got old pubdate %s, expected %s", test.name, changes.OldPubDate, when)
+		}
+	}
+}
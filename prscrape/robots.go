@@ -0,0 +1,131 @@
+package prscrape
+
+// A minimal robots.txt parser.
+//
+// Supports User-agent, Allow, Disallow (with * and $ wildcards) and
+// Crawl-delay. The most specific (longest) matching rule wins, with Allow
+// winning ties.
+//
+// User-agent lines are matched against our product token (eg "ukpr"), in
+// full, ignoring case and any version ("ukpr/1.0").
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type robotsTxt struct {
+	groups []*robotsGroup
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []*robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	length  int
+	pattern *regexp.Regexp
+}
+
+func parseRobots(txt string) *robotsTxt {
+	robots := &robotsTxt{}
+	var group *robotsGroup
+	inAgents := false // still reading the user-agent lines of a group?
+	for _, line := range strings.Split(txt, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		val := strings.TrimSpace(parts[1])
+
+		if key == "user-agent" {
+			if !inAgents {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+				inAgents = true
+			}
+			group.agents = append(group.agents, robotsAgent(val))
+			continue
+		}
+		inAgents = false
+		if group == nil {
+			// rules before any user-agent line
+			continue
+		}
+		switch key {
+		case "allow", "disallow":
+			if val == "" {
+				// "Disallow:" means allow everything
+				continue
+			}
+			rule := compileRobotsRule(val)
+			rule.allow = key == "allow"
+			group.rules = append(group.rules, rule)
+		case "crawl-delay":
+			secs, err := strconv.ParseFloat(val, 64)
+			if err == nil && secs > 0 {
+				group.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+	return robots
+}
+
+func compileRobotsRule(path string) *robotsRule {
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	pat := "^" + strings.Replace(regexp.QuoteMeta(path), `\*`, ".*", -1)
+	if anchored {
+		pat += "$"
+	}
+	return &robotsRule{length: len(path), pattern: regexp.MustCompile(pat)}
+}
+
+// group returns the rules which apply to agent (a product token, as
+// returned by robotsAgent). Groups naming the agent take precedence over "*".
+func (robots *robotsTxt) group(agent string) *robotsGroup {
+	var specific, fallback *robotsGroup
+	for _, group := range robots.groups {
+		for _, name := range group.agents {
+			if name == "*" {
+				if fallback == nil {
+					fallback = group
+				}
+			} else if name != "" && name == agent {
+				if specific == nil {
+					specific = group
+				}
+			}
+		}
+	}
+	if specific != nil {
+		return specific
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return &robotsGroup{}
+}
+
+// allowed checks a path (including any query string)
+func (group *robotsGroup) allowed(path string) bool {
+	var best *robotsRule
+	for _, rule := range group.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if best == nil || rule.length > best.length || (rule.length == best.length && rule.allow) {
+			best = rule
+		}
+	}
+	return best == nil || best.allow
+}
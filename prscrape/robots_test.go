@@ -0,0 +1,191 @@
+package prscrape
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRobotsGroup(t *testing.T) {
+	robots := parseRobots(`
+User-agent: *
+Disallow: /all
+
+User-agent: pr
+User-agent: u
+Disallow: /substring
+
+User-agent:
+Disallow: /empty
+
+User-agent: UKPR/2.0
+User-agent: otherbot
+Disallow: /ours
+`)
+	tests := []struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		// the ukpr group, and only that one
+		{"ukpr", "/ours", false},
+		{"ukpr", "/all", true},
+		{"ukpr", "/substring", true},
+		{"ukpr", "/empty", true},
+		{"otherbot", "/ours", false},
+		// no group of its own, so "*"
+		{"somebot", "/all", false},
+		{"somebot", "/ours", true},
+		{"somebot", "/empty", true},
+		{"", "/all", false},
+	}
+	for _, test := range tests {
+		got := robots.group(test.agent).allowed(test.path)
+		if got != test.want {
+			t.Errorf("%s %s: got %t, expected %t", test.agent, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsGroupFirstWins(t *testing.T) {
+	robots := parseRobots(`
+User-agent: ukpr
+Disallow: /first
+
+User-agent: ukpr
+Disallow: /second
+`)
+	group := robots.group("ukpr")
+	if group.allowed("/first") || !group.allowed("/second") {
+		t.Errorf("expected the first ukpr group to be used")
+	}
+	if got := (&robotsTxt{}).group("ukpr"); !got.allowed("/anything") {
+		t.Errorf("empty robots.txt should allow everything")
+	}
+}
+
+func TestRobotsAllowed(t *testing.T) {
+	group := parseRobots(`
+# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search?
+Allow: /tie
+Disallow: /tie
+Disallow: /news/*/draft
+Disallow: /index.html
+Disallow:
+`).group("ukpr")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/private", false},
+		{"/private/secret.html", false},
+		// longer rule wins
+		{"/private/public/page.html", true},
+		// * and $
+		{"/docs/report.pdf", false},
+		{"/docs/report.pdf?download=1", true},
+		{"/docs/report.pdfx", true},
+		{"/news/2013/draft", false},
+		{"/news/draft", true},
+		// query strings are part of the path
+		{"/search?q=tesco", false},
+		{"/search", true},
+		// Allow wins a tie
+		{"/tie", true},
+		// regexp characters in paths are just characters
+		{"/index.html", false},
+		{"/indexXhtml", true},
+	}
+	for _, test := range tests {
+		if got := group.allowed(test.path); got != test.want {
+			t.Errorf("%s: got %t, expected %t", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsCrawlDelay(t *testing.T) {
+	robots := parseRobots(`
+User-agent: *
+Crawl-delay: 10
+
+User-agent: ukpr
+Crawl-delay: 0.5
+
+User-agent: slowbot
+Crawl-delay: bogus
+`)
+	tests := []struct {
+		agent string
+		want  time.Duration
+	}{
+		{"ukpr", 500 * time.Millisecond},
+		{"otherbot", 10 * time.Second},
+		{"slowbot", 0},
+	}
+	for _, test := range tests {
+		if got := robots.group(test.agent).crawlDelay; got != test.want {
+			t.Errorf("%s: got %s, expected %s", test.agent, got, test.want)
+		}
+	}
+}
+
+func TestRobotsAgent(t *testing.T) {
+	tests := map[string]string{
+		DefaultFetcher.UserAgent: "ukpr",
+		"UKPR/1.0":               "ukpr",
+		"  Mozilla/5.0 (X11)":    "mozilla",
+		"*":                      "*",
+		"":                       "",
+	}
+	for in, want := range tests {
+		if got := robotsAgent(in); got != want {
+			t.Errorf("robotsAgent(%q): got %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestFetchRobots(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		allowed bool
+		ttl     time.Duration
+	}{
+		{http.StatusOK, "User-agent: *\nDisallow: /x\n", true, RobotsTTL},
+		{http.StatusNotFound, "", true, RobotsTTL},
+		{http.StatusForbidden, "", true, RobotsTTL},
+		{http.StatusTooManyRequests, "", false, RobotsRetry},
+		{http.StatusInternalServerError, "", false, RobotsRetry},
+		{http.StatusServiceUnavailable, "", false, RobotsRetry},
+	}
+	f := &Fetcher{UserAgent: "ukpr"}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		u, _ := url.Parse(srv.URL + "/page")
+		robots, ttl := f.fetchRobots(getHost(u.Host), u)
+		srv.Close()
+		if got := robots.group("ukpr").allowed("/page"); got != test.allowed || ttl != test.ttl {
+			t.Errorf("%d: got %t for %s, expected %t for %s", test.status, got, ttl, test.allowed, test.ttl)
+		}
+	}
+
+	// network trouble
+	srv := httptest.NewServer(http.NotFoundHandler())
+	u, _ := url.Parse(srv.URL + "/page")
+	srv.Close()
+	robots, ttl := f.fetchRobots(getHost(u.Host), u)
+	if robots.group("ukpr").allowed("/page") || ttl != RobotsRetry {
+		t.Errorf("unreachable host: got %t for %s, expected false for %s", robots.group("ukpr").allowed("/page"), ttl, RobotsRetry)
+	}
+}
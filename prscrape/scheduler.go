@@ -0,0 +1,249 @@
+package prscrape
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduler periodically runs scrapers, each at its own interval.
+// Scrapers are run in parallel on a fixed pool of workers, but a scraper is
+// never run again while a previous run is still going.
+// A random jitter is applied to each interval, to avoid scrapers bunching
+// up together.
+// Each scraper has a circuit breaker, so a persistently failing scraper is
+// backed off (see breaker.go).
+type Scheduler struct {
+	sync.Mutex
+	// DefaultInterval is used for scrapers which don't set their own
+	DefaultInterval time.Duration
+	// Jitter is the maximum fraction of the interval to randomly add or
+	// subtract (eg 0.1 => +/-10%)
+	Jitter float64
+
+	run  func(*Scraper) error
+	jobs map[string]*job
+	// retired holds jobs removed by Update while they were still running,
+	// so they're picked up again if their scraper comes back
+	retired map[string]*job
+	work    chan *job
+}
+
+type job struct {
+	scraper  *Scraper
+	running  bool
+	lastRun  time.Time
+	lastTook time.Duration
+	nextRun  time.Time
+	breaker  *breaker
+}
+
+// JobStatus describes the scheduling state of a single scraper.
+// Durations are in seconds.
+type JobStatus struct {
+	Name     string    `json:"name"`
+	Interval float64   `json:"interval"`
+	Running  bool      `json:"running"`
+	LastRun  time.Time `json:"last_run"`
+	LastTook float64   `json:"last_took"`
+	NextRun  time.Time `json:"next_run"`
+	// Breaker is the circuit breaker state ("closed", "open" or "half-open")
+	Breaker   string `json:"breaker"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// NewScheduler creates a scheduler with the given number of workers.
+// run is called to perform each scraper run, and returns an error if the
+// run failed.
+func NewScheduler(workers int, defaultInterval time.Duration, run func(*Scraper) error) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	s := &Scheduler{
+		DefaultInterval: defaultInterval,
+		Jitter:          0.1,
+		run:             run,
+		jobs:            make(map[string]*job),
+		retired:         make(map[string]*job),
+		work:            make(chan *job),
+	}
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// Update sets the scrapers to be run. Scrapers already being scheduled
+// keep their timing (even if the Scraper itself is replaced), as do ones
+// which were removed but are still running.
+func (s *Scheduler) Update(scrapers []*Scraper) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	jobs := make(map[string]*job)
+	for _, scraper := range scrapers {
+		j, ok := s.jobs[scraper.Name]
+		if !ok {
+			if j, ok = s.retired[scraper.Name]; ok {
+				delete(s.retired, scraper.Name)
+			}
+		}
+		if ok {
+			j.scraper = scraper
+		} else {
+			// stagger the initial runs a little
+			offset := s.jitter(s.interval(scraper))
+			if offset < 0 {
+				offset = -offset
+			}
+			j = &job{scraper: scraper, nextRun: now.Add(offset), breaker: newBreaker()}
+		}
+		jobs[scraper.Name] = j
+	}
+	for name, j := range s.jobs {
+		if _, kept := jobs[name]; !kept && j.running {
+			s.retired[name] = j
+		}
+	}
+	s.jobs = jobs
+}
+
+// Run dispatches scrapers to the workers as they fall due. Never returns.
+func (s *Scheduler) Run() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		for _, j := range s.due(time.Now()) {
+			select {
+			case s.work <- j:
+			default:
+				// all workers busy - try again next tick
+				s.Lock()
+				j.running = false
+				s.Unlock()
+			}
+		}
+		<-tick.C
+	}
+}
+
+// due returns the jobs ready to run, most overdue first, and marks them
+// as running.
+func (s *Scheduler) due(now time.Time) []*job {
+	s.Lock()
+	defer s.Unlock()
+	var out []*job
+	for _, j := range s.jobs {
+		if !j.running && !now.Before(j.nextRun) && j.breaker.allow(now) {
+			j.running = true
+			out = append(out, j)
+		}
+	}
+	sort.Sort(byNextRun(out))
+	return out
+}
+
+func (s *Scheduler) worker() {
+	for j := range s.work {
+		s.Lock()
+		scraper := j.scraper
+		s.Unlock()
+
+		start := time.Now()
+		err := s.run(scraper)
+		end := time.Now()
+
+		s.Lock()
+		j.running = false
+		if s.retired[scraper.Name] == j {
+			delete(s.retired, scraper.Name)
+		}
+		j.lastRun = start
+		j.lastTook = end.Sub(start)
+		interval := s.interval(scraper)
+		j.nextRun = start.Add(interval + s.jitter(interval))
+		if j.nextRun.Before(end) {
+			j.nextRun = end
+		}
+		if j.breaker.record(err, end) {
+			switch j.breaker.state {
+			case breakerOpen:
+				glog.Warningf("%s: %d failures in a row - backing off until %s", scraper.Name, j.breaker.failures, j.breaker.until.Format(time.RFC3339))
+			case breakerClosed:
+				glog.Infof("%s: recovered", scraper.Name)
+			}
+		}
+		if j.breaker.state == breakerOpen && j.nextRun.Before(j.breaker.until) {
+			j.nextRun = j.breaker.until
+		}
+		if glog.V(1) {
+			glog.Infof("%s: took %s, next run at %s", scraper.Name, j.lastTook, j.nextRun.Format(time.RFC3339))
+		}
+		s.Unlock()
+	}
+}
+
+func (s *Scheduler) interval(scraper *Scraper) time.Duration {
+	if scraper.Interval > 0 {
+		return scraper.Interval
+	}
+	return s.DefaultInterval
+}
+
+// jitter returns a random offset of up to +/- Jitter*interval
+func (s *Scheduler) jitter(interval time.Duration) time.Duration {
+	spread := int64(float64(interval) * s.Jitter)
+	if spread <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(2*spread+1) - spread)
+}
+
+// Status returns the state of all the scheduled scrapers, sorted by name
+func (s *Scheduler) Status() []JobStatus {
+	s.Lock()
+	defer s.Unlock()
+	out := make([]JobStatus, 0, len(s.jobs))
+	for name, j := range s.jobs {
+		out = append(out, JobStatus{
+			Name:     name,
+			Interval: s.interval(j.scraper).Seconds(),
+			Running:  j.running,
+			LastRun:  j.lastRun,
+			LastTook: j.lastTook.Seconds(),
+			NextRun:  j.nextRun,
+
+			Breaker:   j.breaker.state,
+			Failures:  j.breaker.failures,
+			LastError: j.breaker.lastError,
+		})
+	}
+	sort.Sort(byName(out))
+	return out
+}
+
+// ServeHTTP serves up the Status() as json
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(s.Status()); err != nil {
+		glog.Errorf("schedule: %s", err)
+	}
+}
+
+type byNextRun []*job
+
+func (a byNextRun) Len() int           { return len(a) }
+func (a byNextRun) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNextRun) Less(i, j int) bool { return a[i].nextRun.Before(a[j].nextRun) }
+
+type byName []JobStatus
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
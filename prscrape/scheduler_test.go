@@ -0,0 +1,89 @@
+package prscrape
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerUpdateWhileRunning(t *testing.T) {
+	s := NewScheduler(1, time.Hour, func(*Scraper) error { return nil })
+	a := &Scraper{Name: "a"}
+	s.Update([]*Scraper{a})
+	s.jobs["a"].nextRun = time.Now().Add(-time.Minute)
+
+	// (not actually handed to a worker, so it stays running)
+	due := s.due(time.Now())
+	if len(due) != 1 || !due[0].running {
+		t.Fatalf("expected a to be due and running")
+	}
+	running := due[0]
+
+	// removed mid-run, then back again
+	s.Update(nil)
+	if len(s.jobs) != 0 {
+		t.Fatalf("expected no jobs, got %d", len(s.jobs))
+	}
+	a2 := &Scraper{Name: "a"}
+	s.Update([]*Scraper{a2})
+	if s.jobs["a"] != running {
+		t.Fatalf("expected the running job to be picked up again")
+	}
+	if s.jobs["a"].scraper != a2 {
+		t.Errorf("expected the job to use the new scraper")
+	}
+	if due := s.due(time.Now().Add(24 * time.Hour)); len(due) != 0 {
+		t.Errorf("scraper started again while still running")
+	}
+	if len(s.retired) != 0 {
+		t.Errorf("expected nothing left retired, got %d", len(s.retired))
+	}
+}
+
+func TestSchedulerUpdateIdle(t *testing.T) {
+	s := NewScheduler(1, time.Hour, func(*Scraper) error { return nil })
+	s.Update([]*Scraper{{Name: "a"}})
+	old := s.jobs["a"]
+	s.Update(nil)
+	if len(s.retired) != 0 {
+		t.Errorf("idle jobs shouldn't be kept")
+	}
+	s.Update([]*Scraper{{Name: "a"}})
+	if s.jobs["a"] == old {
+		t.Errorf("expected a new job for an idle scraper which was removed")
+	}
+}
+
+func TestSchedulerRetiredJobFinishes(t *testing.T) {
+	started, finish, done := make(chan bool), make(chan bool), make(chan bool)
+	s := NewScheduler(1, time.Hour, func(*Scraper) error {
+		started <- true
+		<-finish
+		return nil
+	})
+	s.Update([]*Scraper{{Name: "a"}})
+	s.jobs["a"].nextRun = time.Now().Add(-time.Minute)
+	j := s.due(time.Now())[0]
+	s.work <- j
+	<-started
+
+	s.Update(nil)
+	if s.retired["a"] != j {
+		t.Fatalf("expected the running job to be retired")
+	}
+	go func() {
+		finish <- true
+		done <- true
+	}()
+	<-done
+	// wait for the worker to tidy up
+	for i := 0; i < 100; i++ {
+		s.Lock()
+		n := len(s.retired)
+		s.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("finished job still retired")
+}
@@ -0,0 +1,127 @@
+package prscrape
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scraperSet holds the currently-installed scrapers.
+// It can be reloaded on the fly (eg after the config file is edited).
+type scraperSet struct {
+	sync.RWMutex
+	all    map[string]*Scraper
+	active map[string]*Scraper
+
+	// load fetches a fresh list of scrapers
+	load func() ([]*Scraper, error)
+	// selected holds the scrapers asked for on the commandline (empty = all)
+	selected []string
+	noScrape bool
+}
+
+func newScraperSet(load func() ([]*Scraper, error), selected []string, noScrape bool) *scraperSet {
+	return &scraperSet{
+		all:      make(map[string]*Scraper),
+		active:   make(map[string]*Scraper),
+		load:     load,
+		selected: selected,
+		noScrape: noScrape,
+	}
+}
+
+// Reload rebuilds the scrapers, replacing the current set.
+// On error, the current set is left untouched.
+func (set *scraperSet) Reload() (added, removed, replaced []string, err error) {
+	scraperList, err := set.load()
+	if err != nil {
+		return
+	}
+
+	all := make(map[string]*Scraper)
+	for _, scraper := range scraperList {
+		all[scraper.Name] = scraper
+	}
+
+	active := make(map[string]*Scraper)
+	if set.noScrape {
+		// leave active empty
+	} else if len(set.selected) > 0 {
+		// user asked for a subset of scrapers
+		for _, name := range set.selected {
+			scraper, ok := all[name]
+			if !ok {
+				err = fmt.Errorf("%s: unknown scraper", name)
+				return
+			}
+			active[name] = scraper
+		}
+	} else {
+		active = all
+	}
+
+	set.Lock()
+	defer set.Unlock()
+	for name := range all {
+		if _, got := set.all[name]; got {
+			replaced = append(replaced, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+	for name := range set.all {
+		if _, got := all[name]; !got {
+			removed = append(removed, name)
+		}
+	}
+	set.all = all
+	set.active = active
+	return
+}
+
+// Active returns the scrapers which should be run
+func (set *scraperSet) Active() []*Scraper {
+	set.RLock()
+	defer set.RUnlock()
+	out := make([]*Scraper, 0, len(set.active))
+	for _, scraper := range set.active {
+		out = append(out, scraper)
+	}
+	return out
+}
+
+// Get returns the named scraper, active or not (nil if not installed)
+func (set *scraperSet) Get(name string) *Scraper {
+	set.RLock()
+	defer set.RUnlock()
+	return set.all[name]
+}
+
+// Retention builds a retention policy from the installed scrapers
+func (set *scraperSet) Retention(defaultRetention time.Duration) *RetentionPolicy {
+	set.RLock()
+	defer set.RUnlock()
+	policy := &RetentionPolicy{
+		Default:   defaultRetention,
+		PerSource: make(map[string]time.Duration),
+	}
+	for name, scraper := range set.all {
+		if scraper.Retention != 0 {
+			policy.PerSource[name] = scraper.Retention
+		}
+	}
+	return policy
+}
+
+// Names returns the (sorted) names of all installed scrapers, active or not
+func (set *scraperSet) Names() []string {
+	set.RLock()
+	defer set.RUnlock()
+	out := make([]string, 0, len(set.all))
+	for name := range set.all {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
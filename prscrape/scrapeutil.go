@@ -3,8 +3,11 @@ package prscrape
 // utility functions to help out with scraping html
 
 import (
+	"code.google.com/p/cascadia"
 	"code.google.com/p/go.net/html"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -137,10 +140,60 @@ func DescribeNode(n *html.Node) string {
 	return "???" // not an element
 }
 
+// TruncateAt removes the first node under container matching sel, along with
+// everything following it.
+// Returns false if there was no matching node.
+func TruncateAt(container *html.Node, sel cascadia.Selector) bool {
+	for _, match := range sel.MatchAll(container) {
+		if match == container {
+			continue
+		}
+		for n := match; n != container; n = n.Parent {
+			for n.NextSibling != nil {
+				n.Parent.RemoveChild(n.NextSibling)
+			}
+		}
+		match.Parent.RemoveChild(match)
+		return true
+	}
+	return false
+}
+
+// FindEnd returns the position of the start of the first line in txt
+// matching any of the patterns, or -1 if none match.
+func FindEnd(txt string, pats []*regexp.Regexp) int {
+	pos := -1
+	for _, pat := range pats {
+		loc := pat.FindStringIndex(txt)
+		if loc != nil && (pos == -1 || loc[0] < pos) {
+			pos = loc[0]
+		}
+	}
+	if pos == -1 {
+		return -1
+	}
+	return strings.LastIndex(txt[:pos], "\n") + 1
+}
+
 // dumpTree is a debug helper to display a tree of nodes
 func DumpTree(n *html.Node, depth int) {
-	fmt.Printf("%s%s\n", strings.Repeat(" ", depth), DescribeNode(n))
+	fdumpTree(os.Stdout, n, depth)
+}
+
+// fdumpTree is like DumpTree, but writes to w
+func fdumpTree(w io.Writer, n *html.Node, depth int) {
+	fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", depth), DescribeNode(n))
 	for child := n.FirstChild; child != nil; child = child.NextSibling {
-		DumpTree(child, depth+1)
+		fdumpTree(w, child, depth+1)
+	}
+}
+
+// NodePath describes the position of a node in the document, eg:
+// "<html> <body> <div#main> <h1.title>"
+func NodePath(n *html.Node) string {
+	path := []string{}
+	for ; n != nil && n.Type != html.DocumentNode; n = n.Parent {
+		path = append([]string{DescribeNode(n)}, path...)
 	}
+	return strings.Join(path, " ")
 }
@@ -0,0 +1,188 @@
+package prscrape
+
+// Full-text search over the archive, using an sqlite FTS5 index.
+//
+// The index is kept in step with the press_release table by triggers, so
+// stashing and pruning need do nothing special.
+// The triggers live in the db file, so they're dropped if the db is opened
+// by a build without FTS5 (they'd make every change to press_release fail).
+// The index can't be kept up to date by that build, so it's rebuilt when
+// an FTS5 build finds the triggers missing.
+//
+// NOTE: FTS5 isn't compiled into go-sqlite3 by default. Build with:
+//   go build -tags sqlite_fts5
+// Without it, everything else works but searching is disabled.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"strings"
+	"time"
+)
+
+var ErrNoSearch = errors.New("full-text search not available (sqlite built without FTS5?)")
+
+// SearchQuery holds the criteria for a search
+type SearchQuery struct {
+	// Text is an FTS5 query string, eg: `tesco AND "horse meat"`
+	Text string
+	// Sources restricts results to these sources (empty = all)
+	Sources []string
+	// Since and Until limit the publication dates
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// SearchHit is a single search result
+type SearchHit struct {
+	ID      int
+	Score   float64
+	Snippet string
+	Release *PressRelease
+}
+
+// the triggers which keep the index up to date
+var searchTriggers = []string{"press_release_fts_ins", "press_release_fts_del", "press_release_fts_upd"}
+
+// initSearch sets up the full-text index, if possible.
+func (store *DBStore) initSearch() {
+	var haveFTS5 bool
+	err := store.db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&haveFTS5)
+	if err != nil {
+		panic(err)
+	}
+	if !haveFTS5 {
+		glog.Warningf("%s", ErrNoSearch)
+		store.dropSearchTriggers()
+		return
+	}
+
+	var cnt int
+	err = store.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name='press_release_fts'").Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	exists := cnt > 0
+	err = store.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name IN ($1,$2,$3)", searchTriggers[0], searchTriggers[1], searchTriggers[2]).Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	// (without all the triggers, the index could be out of date)
+	inSync := exists && cnt == len(searchTriggers)
+
+	_, err = store.db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS press_release_fts USING fts5(
+         title, content, content='press_release', content_rowid='id')`)
+	if err != nil {
+		glog.Warningf("full-text search disabled: %s", err)
+		store.dropSearchTriggers()
+		return
+	}
+
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS press_release_fts_ins AFTER INSERT ON press_release BEGIN
+           INSERT INTO press_release_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+         END`,
+		`CREATE TRIGGER IF NOT EXISTS press_release_fts_del AFTER DELETE ON press_release BEGIN
+           INSERT INTO press_release_fts(press_release_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+         END`,
+		`CREATE TRIGGER IF NOT EXISTS press_release_fts_upd AFTER UPDATE ON press_release BEGIN
+           INSERT INTO press_release_fts(press_release_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+           INSERT INTO press_release_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+         END`,
+	}
+	for _, trigger := range triggers {
+		if _, err := store.db.Exec(trigger); err != nil {
+			panic(err)
+		}
+	}
+
+	if !inSync {
+		// index everything already in the db
+		fmt.Printf("BUILDING full-text index...")
+		_, err = store.db.Exec("INSERT INTO press_release_fts(press_release_fts) VALUES('rebuild')")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("done.\n")
+	}
+	store.searchable = true
+}
+
+// dropSearchTriggers removes any triggers left by a build with FTS5
+func (store *DBStore) dropSearchTriggers() {
+	for _, name := range searchTriggers {
+		if _, err := store.db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Search returns the press releases matching q, best matches first
+func (store *DBStore) Search(q *SearchQuery) ([]*SearchHit, error) {
+	if !store.searchable {
+		return nil, ErrNoSearch
+	}
+
+	where := []string{"press_release_fts MATCH ?"}
+	args := []interface{}{q.Text}
+	if len(q.Sources) > 0 {
+		where = append(where, "press_release.source IN (?"+strings.Repeat(",?", len(q.Sources)-1)+")")
+		for _, source := range q.Sources {
+			args = append(args, source)
+		}
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "julianday(press_release.pubdate)>=julianday(?)")
+		args = append(args, sqlTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "julianday(press_release.pubdate)<julianday(?)")
+		args = append(args, sqlTime(q.Until))
+	}
+	sqlStr := "SELECT " + prFields + `,
+         bm25(press_release_fts), snippet(press_release_fts, 1, '[', ']', '...', 16)
+       FROM press_release_fts JOIN press_release ON press_release.id=press_release_fts.rowid
+       WHERE ` + strings.Join(where, " AND ") + ` ORDER BY bm25(press_release_fts)`
+	if q.Limit > 0 {
+		sqlStr += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := store.db.Query(sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hits := []*SearchHit{}
+	for rows.Next() {
+		hit := &SearchHit{}
+		var rank float64
+		ev, err := scanPressRelease(rows, &rank, &hit.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		hit.ID = ev.id
+		hit.Release = ev.payload
+		// bm25() gives better matches more negative values
+		hit.Score = -rank
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// searchMain runs a search from the commandline, dumping results to stdout
+func searchMain(store *DBStore, q *SearchQuery) error {
+	hits, err := store.Search(q)
+	if err != nil {
+		return err
+	}
+	for _, hit := range hits {
+		pr := hit.Release
+		fmt.Printf("%d %s %s \"%s\" (%.2f)\n", hit.ID, pr.Source, pr.PubDate.Format("2006-01-02"), pr.Title, hit.Score)
+		fmt.Printf("  %s\n", pr.Permalink)
+		fmt.Printf("  %s\n", CompressSpace(hit.Snippet))
+	}
+	return nil
+}
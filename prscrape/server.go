@@ -10,10 +10,17 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-// helper to fetch and scrape an individual press release
+// helper to fetch and scrape an individual press release.
+// The permalink is updated to the canonical url of the press release (if
+// it declares one) or the url we were redirected to, with the original
+// url(s) kept as aliases.
 func scrape(scraper *Scraper, pr *PressRelease) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -26,128 +33,439 @@ func scrape(scraper *Scraper, pr *PressRelease) (err error) {
 		return
 	}
 
-	root, err := fetchPage(pageURL)
+	fetcher := scraper.Fetcher
+	if fetcher == nil {
+		fetcher = DefaultFetcher
+	}
+	fetched, err := fetcher.fetchPage(pageURL)
 	if err != nil {
 		return
 	}
+	return scrapePage(scraper, pr, fetched)
+}
+
+// scrapePage runs the scraper over an already-fetched page
+func scrapePage(scraper *Scraper, pr *PressRelease, fetched *fetchedPage) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.New(fmt.Sprintf("%v", e))
+		}
+	}()
+
+	for _, u := range fetched.Redirects {
+		pr.AddURL(u)
+	}
+	pr.AddURL(fetched.URL.String())
+	if fetched.Canonical != "" {
+		pr.AddURL(fetched.Canonical)
+		pr.Permalink = fetched.Canonical
+	} else {
+		pr.Permalink = fetched.URL.String()
+	}
 
-	err = scraper.Scrape(pr, root)
+	err = scraper.Scrape(pr, fetched.Root)
 	if err != nil {
 		return
 	}
+	pr.raw = newRawPage(fetched.fetchResult)
 	return
 }
 
-// run a scraper
-func doit(scraper *Scraper, store Store, sseSrv *eventsource.Server) {
+// run a scraper.
+// Returns an error if discovery failed (failures scraping individual press
+// releases are just logged, and counted in the stats).
+// Afterward, any recently stored press releases due a recheck are scraped
+// again (see revisions.go).
+func doit(scraper *Scraper, store Store, sseSrv *eventsource.Server) (stats RunStats, err error) {
 	if glog.V(1) {
 		glog.Infof("%s: Discover", scraper.Name)
 	}
+	start := time.Now()
 	pressReleases, err := scraper.Discover()
-	if err != nil {
-		glog.Errorf("%s: Discover failed: %s", scraper.Name, err)
-		return
+	metricDiscoverDuration.ObserveSince(start, scraper.Name)
+	if err == errNotModified {
+		// nothing's changed since last time, so no new links to look at
+		metricDiscoverRuns.Inc(scraper.Name, "not_modified")
+		if glog.V(1) {
+			glog.Infof("%s: not modified", scraper.Name)
+		}
+		stats.NotModified = true
+		err = nil
+	} else {
+		if err != nil {
+			commitValidators(scraper.Name, false)
+			metricDiscoverRuns.Inc(scraper.Name, "error")
+			glog.Errorf("%s: Discover failed: %s", scraper.Name, err)
+			return
+		}
+		metricDiscoverRuns.Inc(scraper.Name, "ok")
+		metricDiscovered.Add(float64(len(pressReleases)), scraper.Name)
+		handleDiscovered(scraper, store, sseSrv, pressReleases, &stats)
+		// only now is it safe to skip the pages next time
+		commitValidators(scraper.Name, stats.Failed == 0)
 	}
 
+	// look for changes to recent ones
+	if rs, ok := store.(revisionStore); ok {
+		recheck(scraper, rs, sseSrv, &stats)
+	}
+	return
+}
+
+// handleDiscovered scrapes and stashes any press releases we haven't
+// already got
+func handleDiscovered(scraper *Scraper, store Store, sseSrv *eventsource.Server, pressReleases []*PressRelease, stats *RunStats) {
 	// cull out the ones we've already got
-	oldCount := len(pressReleases)
+	stats.Discovered = len(pressReleases)
 	pressReleases = store.WhichAreNew(pressReleases)
+	stats.New = len(pressReleases)
 	if glog.V(1) {
-		glog.Infof("%s: %d releases (%d new)", scraper.Name, oldCount, len(pressReleases))
+		glog.Infof("%s: %d releases (%d new)", scraper.Name, stats.Discovered, stats.New)
 	}
 	// for all the new ones:
 	for _, pr := range pressReleases {
 		if scraper.Scrape != nil {
-			err = scrape(scraper, pr)
+			start := time.Now()
+			err := scrape(scraper, pr)
+			metricScrapeDuration.ObserveSince(start, scraper.Name)
 			if err != nil {
+				metricScrapes.Inc(scraper.Name, "error")
+				stats.Failed++
+				stats.LastError = fmt.Sprintf("%s (%s)", err, pr.Permalink)
 				if glog.V(1) {
 					glog.Infof("%s: %s %s\n", scraper.Name, err, pr.Permalink)
 				}
 				continue
 			}
+			metricScrapes.Inc(scraper.Name, "ok")
+			stats.Scraped++
+
+			// now we know the canonical url, we might find we've already
+			// got this one (eg if the index page used a tracking url)
+			merged, err := store.MergeURLs(pr)
+			if err != nil {
+				stats.Failed++
+				stats.LastError = fmt.Sprintf("merge failed: %s (%s)", err, pr.Permalink)
+				glog.Errorf("%s: failed to merge urls for %s (%s)", scraper.Name, pr.Permalink, err)
+				continue
+			}
+			if merged {
+				if glog.V(1) {
+					glog.Infof("%s: already got %s\n", scraper.Name, pr.Permalink)
+				}
+				continue
+			}
+		}
+		// sanity check before letting it loose
+		if problems := validationFor(scraper).Check(pr, time.Now()); len(problems) > 0 {
+			stats.Quarantined++
+			metricQuarantined.Inc(scraper.Name)
+			glog.Warningf("%s: quarantined %s (%s)", scraper.Name, pr.Permalink, strings.Join(problems, "; "))
+			if err := store.Quarantine(pr, problems); err != nil {
+				stats.Failed++
+				stats.LastError = fmt.Sprintf("quarantine failed: %s (%s)", err, pr.Permalink)
+				glog.Errorf("%s: failed to quarantine %s (%s)", scraper.Name, pr.Permalink, err)
+			}
+			continue
 		}
-		// TODO: sanity check required fields
 
 		// stash the new press release
 		ev, err := store.Stash(pr)
 		if err != nil {
+			metricStashErrors.Inc(scraper.Name)
+			stats.Failed++
+			stats.LastError = fmt.Sprintf("stash failed: %s (%s)", err, pr.Permalink)
 			glog.Errorf("%s: failed to stash %s (%s)", scraper.Name, pr.Permalink, err)
-		} else {
-			glog.Infof("%s: added %s", scraper.Name, pr.Permalink)
+			continue
 		}
+		stats.Added++
+		glog.Infof("%s: added %s", scraper.Name, pr.Permalink)
 
 		if sseSrv != nil {
 			// broadcast it to any connected clients
 			sseSrv.Publish([]string{pr.Source}, ev)
+			metricEventsPublished.Inc(pr.Source)
 		}
 	}
 }
 
+// loadScrapers builds the full list of scrapers - the ones provided in code
+// by configfunc, plus any defined in the config file.
+// Scrapers in the config file replace coded ones of the same name.
+func loadScrapers(configFile string, configfunc ConfigureFunc, historical bool) ([]*Scraper, error) {
+	var scraperList []*Scraper
+	if configfunc != nil {
+		scraperList = configfunc(historical)
+	}
+	if configFile == "" {
+		return scraperList, nil
+	}
+
+	fromConfig, err := LoadConfig(configFile, historical)
+	if err != nil {
+		return nil, err
+	}
+	overridden := make(map[string]bool)
+	for _, scraper := range fromConfig {
+		overridden[scraper.Name] = true
+	}
+	out := make([]*Scraper, 0, len(scraperList)+len(fromConfig))
+	for _, scraper := range scraperList {
+		if !overridden[scraper.Name] {
+			out = append(out, scraper)
+		}
+	}
+	return append(out, fromConfig...), nil
+}
+
+// parseDateFlag parses a YYYY-MM-DD date from the commandline ("" => zero time)
+func parseDateFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
 // ServerMain is the entry point for running the server.
 // handles commandline flags and all that stuff - the idea is that you can
 // easily write a new server with a different bunch of scrapers. The real
-// main() would just be a small stub which instantiates a bunch of scrapers,
-// then passes control over to here. See ukpr/main.go for an example
-func ServerMain(dbFile string, configfunc ConfigureFunc) {
+// main() would just be a small stub which instantiates any custom scrapers,
+// then passes control over to here. See ukpr/main.go for an example.
+// configFile is the default config file to load scrapers from (overridable
+// with the -config flag). Use "" for none.
+func ServerMain(dbFile string, configFile string, configfunc ConfigureFunc) {
 	var port = flag.Int("port", 9998, "port to run server on")
-	var interval = flag.Int("interval", 60*10, "interval at which to poll source sites for new releases (in seconds)")
+	var adminAddr = flag.String("adminaddr", "127.0.0.1:9999", "address to serve the admin endpoints on (\"\" to turn them off)")
+	var interval = flag.Int("interval", 60*10, "default interval at which to poll source sites for new releases (in seconds)")
+	var workers = flag.Int("workers", 4, "max number of scrapers to run at once")
+	var jitter = flag.Float64("jitter", 0.1, "randomly vary scraper intervals by up to this fraction")
 	var testMode = flag.Bool("t", false, "Test mode - dumping to stdout. Doesn't run server or alter the database.")
 	var noScrape = flag.Bool("noscrape", false, "Don't run _any_ scrapers")
 	var briefFlag = flag.Bool("b", false, "Brief (testing mode output)")
 	var listFlag = flag.Bool("l", false, "List scrapers and exit")
 	var historicalFlag = flag.Bool("historical", false, "Run historical version of scrapers, where available")
+	var retentionFlag = flag.Int("retention", 0, "default number of days to keep press releases for (0 = forever)")
+	var searchFlag = flag.String("search", "", "Search the archive (restricted to any scrapers listed) and exit")
+	var tryFlag = flag.String("try", "", "Try out selectors (given as name=selector args) against a url or local html file, and exit")
+	var reprocessFlag = flag.Bool("reprocess", false, "Rerun the scrapers listed over their stored pages, show what changes, and exit")
+	var writeFlag = flag.Bool("write", false, "Store the changes found by -reprocess")
+	var sinceFlag = flag.String("since", "", "Only consider press releases published (or for -reprocess, scraped) on or after this date (YYYY-MM-DD)")
+	var untilFlag = flag.String("until", "", "Only consider press releases published (or for -reprocess, scraped) before this date (YYYY-MM-DD)")
+	var hostDelayFlag = flag.Float64("hostdelay", HostDelay.Seconds(), "minimum time between requests to the same host (in seconds)")
+	var hostConnsFlag = flag.Int("hostconns", HostConcurrency, "max number of simultaneous requests to the same host")
+	var recheckFlag = flag.Int("recheck", 0, "default number of hours after storing press releases to keep checking them for changes (0 = don't)")
+	var rawFlag = flag.Bool("raw", KeepRaw, "keep a copy of the page each press release was scraped from")
+	var quarantineFlag = flag.String("quarantine", "", "Manage quarantined press releases and exit (list, show, fix, release or discard)")
+	var forceFlag = flag.Bool("force", false, "Release quarantined press releases even if they still have problems")
+	var recordFlag = flag.String("record", "", "Save every response fetched into this directory (for -replay)")
+	var replayFlag = flag.String("replay", "", "Serve responses from this directory (saved by -record) instead of fetching them")
+	var configFlag = flag.String("config", configFile, "config file defining scrapers (\"\" for none)")
 
 	flag.Parse()
 
+	HostDelay = time.Duration(*hostDelayFlag * float64(time.Second))
+	HostConcurrency = *hostConnsFlag
+	RecheckWindow = time.Duration(*recheckFlag) * time.Hour
+	KeepRaw = *rawFlag
+
+	// record or replay all the http traffic?
+	if *recordFlag != "" || *replayFlag != "" {
+		if *recordFlag != "" && *replayFlag != "" {
+			glog.Fatal("can't -record and -replay at the same time")
+		}
+		c := &Cassette{Dir: *replayFlag}
+		if *recordFlag != "" {
+			c = &Cassette{Dir: *recordFlag, Record: true}
+			glog.Infof("recording responses to %s", c.Dir)
+		} else {
+			if _, err := os.Stat(c.Dir); err != nil {
+				glog.Fatal(err)
+			}
+			glog.Infof("replaying responses from %s", c.Dir)
+		}
+		if err := UseCassette(c); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
 	// set up scrapers
-	scraperList := configfunc(*historicalFlag)
+	load := func() ([]*Scraper, error) {
+		return loadScrapers(*configFlag, configfunc, *historicalFlag)
+	}
 
 	if *listFlag {
 		// list scrapers and exit
+		scraperList, err := load()
+		if err != nil {
+			glog.Fatal(err)
+		}
 		for _, scraper := range scraperList {
 			fmt.Println(scraper.Name)
 		}
 		return
 	}
 
-	allScrapers := make(map[string]*Scraper)
-	for _, scraper := range scraperList {
-		allScrapers[scraper.Name] = scraper
-	}
-
-	activeScrapers := make(map[string]*Scraper)
-	if *noScrape {
-		// leave activeScrapers empty
-	} else if len(flag.Args()) > 0 {
-		// user asked for a subset of scrapers
-		for _, name := range flag.Args() {
-			scraper, ok := allScrapers[name]
-			if !ok {
-				panic(fmt.Sprintf("%s: unknown scraper", name))
-			}
-			activeScrapers[name] = scraper
+	if *searchFlag != "" {
+		var err error
+		q := &SearchQuery{Text: *searchFlag, Sources: flag.Args(), Limit: 50}
+		if q.Since, err = parseDateFlag(*sinceFlag); err != nil {
+			glog.Fatal(err)
 		}
-	} else {
-		activeScrapers = allScrapers
+		if q.Until, err = parseDateFlag(*untilFlag); err != nil {
+			glog.Fatal(err)
+		}
+		if err = searchMain(NewDBStore(dbFile), q); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	if *tryFlag != "" {
+		if err := tryMain(*tryFlag, flag.Args(), *configFlag, os.Stdout); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	if *reprocessFlag {
+		since, err := parseDateFlag(*sinceFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		until, err := parseDateFlag(*untilFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		scraperList, err := load()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if err = reprocessMain(NewDBStore(dbFile), scraperList, flag.Args(), since, until, *writeFlag, os.Stdout); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	if *quarantineFlag != "" {
+		// (scrapers are only needed for their validation rules)
+		scraperList, err := load()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if err = quarantineMain(NewDBStore(dbFile), scraperList, *quarantineFlag, flag.Args(), *forceFlag); err != nil {
+			glog.Fatal(err)
+		}
+		return
 	}
 
 	// set up store and SSE server
 	// using a common store for all scrapers
 	// but no reason they couldn't all have their own store
 	var store Store
+	var db *DBStore
 	var sseSrv *eventsource.Server
+	var channels *sseChannels
+	// the admin endpoints can change things, so they're kept off the
+	// public port
+	admin := http.NewServeMux()
 
 	if *testMode {
 		store = NewTestStore(*briefFlag)
-		sseSrv = nil
 	} else {
-		store = NewDBStore(dbFile)
+		db = NewDBStore(dbFile)
+		store = db
+		// the db remembers which discovery pages haven't changed
+		// (needs to be set before the scrapers pick up DefaultFetcher)
+		DefaultFetcher.Cache = db
+		go logCacheStats(time.Hour)
+	}
+
+	scrapers := newScraperSet(load, flag.Args(), *noScrape)
+	if _, _, _, err := scrapers.Reload(); err != nil {
+		glog.Fatal(err)
+	}
+
+	if db != nil {
+		newGaugeFunc("ukpr_db_size_bytes", "Size of the database.", db.Size)
+		go db.RunPruner(time.Hour, func() *RetentionPolicy {
+			return scrapers.Retention(time.Duration(*retentionFlag) * 24 * time.Hour)
+		})
 		sseSrv = eventsource.NewServer()
 		// register all scrapers as sse sources, even if they're not active
-		for name, _ := range allScrapers {
-			sseSrv.Register(name, store)
-			http.Handle("/"+name+"/", sseSrv.Handler(name))
+		channels = newSSEChannels(sseSrv, store)
+		channels.Update(scrapers.Names())
+		http.Handle("/", channels)
+		http.Handle("/browse/", &browser{db, scrapers})
+		a := &api{db, scrapers, sseSrv}
+		http.Handle("/api/", a)
+		admin.Handle("/admin/quarantine", quarantineAPI{a})
+		admin.Handle("/admin/quarantine/", quarantineAPI{a})
+		// let clients know when a site looks to have changed
+		drift.Notify(func(alert *driftAlert) {
+			sseSrv.Publish([]string{controlChannel}, &driftEvent{alert})
+			metricEventsPublished.Inc(controlChannel)
+		})
+	}
+
+	// run the active scrapers, each at its own interval
+	status := newStatusRegistry()
+	sched := NewScheduler(*workers, time.Duration(*interval)*time.Second, func(scraper *Scraper) error {
+		start := time.Now()
+		stats, err := doit(scraper, store, sseSrv)
+		status.Record(scraper.Name, start, time.Since(start), stats, err)
+		return err
+	})
+	sched.Jitter = *jitter
+	sched.Update(scrapers.Active())
+	http.Handle("/schedule", sched)
+	http.Handle("/status", &statusPage{status, sched})
+	http.HandleFunc("/metrics", serveMetrics)
+
+	// reloading picks up changes to the scraper definitions without
+	// disturbing connected clients
+	reload := func() error {
+		added, removed, replaced, err := scrapers.Reload()
+		if err != nil {
+			glog.Errorf("reload failed: %s", err)
+			return err
+		}
+		if channels != nil {
+			channels.Update(scrapers.Names())
 		}
+		sched.Update(scrapers.Active())
+		glog.Infof("reloaded scrapers (%d added, %d removed, %d replaced)", len(added), len(removed), len(replaced))
+		return nil
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for _ = range hup {
+			glog.Info("SIGHUP received")
+			reload()
+		}
+	}()
+	admin.HandleFunc("/admin/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "reloaded %d scrapers\n", len(scrapers.Names()))
+	})
+	if db != nil {
+		admin.HandleFunc("/admin/reprocess", reprocessHandler(db, scrapers, sseSrv))
+	}
+	if *adminAddr != "" {
+		al, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer al.Close()
+		glog.Infof("admin endpoints on %s", *adminAddr)
+		go http.Serve(al, admin)
 	}
 
 	//
@@ -157,18 +475,7 @@ func ServerMain(dbFile string, configfunc ConfigureFunc) {
 	}
 	defer l.Close()
 
-	// cheesy task to periodically run the active scrapers
-	go func() {
-		for {
-			for _, scraper := range activeScrapers {
-				doit(scraper, store, sseSrv)
-			}
-			if glog.V(1) {
-				glog.Info("sleeping")
-			}
-			time.Sleep(time.Duration(*interval) * time.Second)
-		}
-	}()
+	go sched.Run()
 
 	glog.Infof("running on port %d", *port)
 	http.Serve(l, nil)
@@ -0,0 +1,250 @@
+package prscrape
+
+// Status of the scrapers, for keeping an eye on their health.
+//
+//   /status              - html summary
+//   /status?format=json  - the same, as json
+//
+// The status is only held in memory, so starts afresh on restart.
+// Selectors which have stopped matching are flagged up too (see drift.go).
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunStats holds the results of a single scraper run
+type RunStats struct {
+	// Discovered is the number of press releases found by discovery
+	Discovered int `json:"discovered"`
+	// New is the number of those we didn't already have
+	New int `json:"new"`
+	// Scraped is the number successfully scraped
+	Scraped int `json:"scraped"`
+	// Failed is the number which failed to scrape or be stored
+	Failed int `json:"failed"`
+	// Added is the number added to the store
+	Added int `json:"added"`
+	// Quarantined is the number which failed validation
+	Quarantined int `json:"quarantined"`
+	// Rechecked is the number of stored press releases scraped again to
+	// look for changes, and Updated the number which had changed
+	Rechecked int `json:"rechecked"`
+	Updated   int `json:"updated"`
+	// NotModified is set if discovery found nothing had changed since the
+	// last run (so there was nothing new to look at)
+	NotModified bool `json:"not_modified,omitempty"`
+	// LastError is the last error scraping or stashing a press release
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ScraperStatus holds the recent history of a scraper
+type ScraperStatus struct {
+	Name string `json:"name"`
+	// Runs is the number of runs since startup, and FirstRun when the
+	// first one was
+	Runs     int       `json:"runs"`
+	FirstRun time.Time `json:"first_run"`
+	// LastRun is when the last run started, and LastTook how long it
+	// took (in seconds)
+	LastRun  time.Time `json:"last_run"`
+	LastTook float64   `json:"last_took"`
+	// Last holds the stats from the last run
+	Last RunStats `json:"last"`
+	// LastFound is the last time discovery turned up any press releases
+	// (or found the pages unchanged since it did), and LastAdded the last
+	// time anything new was stored
+	LastFound time.Time `json:"last_found"`
+	LastAdded time.Time `json:"last_added"`
+	// found is set if the last discovery which wasn't "not modified"
+	// turned anything up
+	found bool
+	// LastError is the last error which caused a run to fail
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	// Breaker is the circuit breaker state, from the scheduler
+	Breaker string `json:"breaker,omitempty"`
+	// Stale is set if nothing has been found for StatusStale
+	Stale bool `json:"stale"`
+	// Selectors is the history of the scraper's selectors, and Drifted
+	// set if any of them have stopped matching (see drift.go)
+	Selectors []*SelectorStatus `json:"selectors"`
+	Drifted   bool              `json:"drifted"`
+}
+
+// statusRegistry tracks the status of all the scrapers
+type statusRegistry struct {
+	sync.Mutex
+	scrapers map[string]*ScraperStatus
+}
+
+func newStatusRegistry() *statusRegistry {
+	return &statusRegistry{scrapers: make(map[string]*ScraperStatus)}
+}
+
+// Record notes the outcome of a scraper run
+func (reg *statusRegistry) Record(name string, start time.Time, took time.Duration, stats RunStats, err error) {
+	reg.Lock()
+	defer reg.Unlock()
+	st, ok := reg.scrapers[name]
+	if !ok {
+		st = &ScraperStatus{Name: name}
+		reg.scrapers[name] = st
+	}
+	if st.Runs == 0 {
+		st.FirstRun = start
+	}
+	st.Runs++
+	st.LastRun = start
+	st.LastTook = took.Seconds()
+	st.Last = stats
+	if !stats.NotModified && err == nil {
+		st.found = stats.Discovered > 0
+	}
+	// unchanged pages still have whatever was on them last time
+	if stats.Discovered > 0 || (stats.NotModified && st.found) {
+		st.LastFound = start
+	}
+	if stats.Added > 0 {
+		st.LastAdded = start
+	}
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorAt = start
+	}
+}
+
+// Get returns a copy of the status of the named scrapers (scrapers which
+// haven't run yet are included, but empty)
+func (reg *statusRegistry) Get(names []string) []*ScraperStatus {
+	reg.Lock()
+	defer reg.Unlock()
+	out := make([]*ScraperStatus, 0, len(names))
+	for _, name := range names {
+		st := &ScraperStatus{Name: name}
+		if got, ok := reg.scrapers[name]; ok {
+			*st = *got
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// stale returns true if the scraper hasn't found anything for a while
+func (st *ScraperStatus) stale() bool {
+	if st.Runs == 0 {
+		return false
+	}
+	if st.LastFound.IsZero() {
+		return time.Since(st.FirstRun) > StatusStale
+	}
+	return time.Since(st.LastFound) > StatusStale
+}
+
+// statusPage serves up the status of the scheduled scrapers
+type statusPage struct {
+	registry *statusRegistry
+	sched    *Scheduler
+}
+
+// StatusStale is how long a scraper can go without finding anything before
+// it's flagged up on the status page
+var StatusStale = 72 * time.Hour
+
+var statusTmpl = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return (time.Since(t) / time.Second * time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>status - ukpr</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.bad { background: #fdd; }
+.error { color: #a00; font-size: smaller; }
+</style>
+</head>
+<body>
+<h1>Scraper status</h1>
+<table>
+<tr><th>scraper</th><th>runs</th><th>last run</th><th>took</th><th>discovered</th><th>new</th><th>scraped</th><th>failed</th><th>quarantined</th><th>added</th><th>updated</th><th>last found</th><th>last added</th><th>breaker</th><th>selectors</th><th>last error</th></tr>
+{{range .}}<tr{{if .Bad}} class="bad"{{end}}>
+<td><a href="/browse/{{.Name}}/">{{.Name}}</a></td>
+<td>{{.Runs}}</td>
+<td>{{ago .LastRun}}</td>
+<td>{{printf "%.1f" .LastTook}}s</td>
+<td>{{if .Last.NotModified}}unchanged{{else}}{{.Last.Discovered}}{{end}}</td>
+<td>{{.Last.New}}</td>
+<td>{{.Last.Scraped}}</td>
+<td>{{.Last.Failed}}</td>
+<td>{{.Last.Quarantined}}</td>
+<td>{{.Last.Added}}</td>
+<td>{{.Last.Updated}}/{{.Last.Rechecked}}</td>
+<td>{{ago .LastFound}}</td>
+<td>{{ago .LastAdded}}</td>
+<td>{{.Breaker}}</td>
+<td>{{range .Selectors}}{{if .Drifted}}<span class="error" title="{{.Selector}}">{{.Role}} drifted ({{ago .DriftedAt}})</span><br>{{end}}{{end}}{{if not .Drifted}}{{if .Selectors}}ok{{end}}{{end}}</td>
+<td class="error">{{if .LastError}}{{.LastError}} ({{ago .LastErrorAt}}){{end}}{{if .Last.LastError}}<br>{{.Last.LastError}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Status returns the status of all the scheduled scrapers, sorted by name
+// (as per the Scheduler)
+func (page *statusPage) Status() []*ScraperStatus {
+	jobs := page.sched.Status()
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		names[i] = j.Name
+	}
+	out := page.registry.Get(names)
+	for i, j := range jobs {
+		out[i].Breaker = j.Breaker
+		out[i].Stale = out[i].stale()
+		out[i].Selectors = drift.Get(j.Name)
+		for _, sel := range out[i].Selectors {
+			if sel.Drifted {
+				out[i].Drifted = true
+			}
+		}
+	}
+	return out
+}
+
+func (page *statusPage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := page.Status()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			glog.Errorf("status: %s", err)
+		}
+		return
+	}
+
+	type row struct {
+		*ScraperStatus
+		Bad bool
+	}
+	rows := make([]row, len(status))
+	for i, st := range status {
+		rows[i] = row{st, st.Breaker != breakerClosed || st.Last.Failed > 0 || st.Last.Quarantined > 0 || st.Stale || st.Drifted}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTmpl.Execute(w, rows); err != nil {
+		glog.Errorf("status: %s", err)
+	}
+}
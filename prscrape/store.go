@@ -21,13 +21,15 @@ import (
 	//_ "github.com/mattn/go-sqlite3"
 	"fmt"
 	"strconv"
-
-//	"time"
+	"strings"
+	"time"
 )
 
 type Store interface {
 	WhichAreNew(incoming []*PressRelease) []*PressRelease
+	MergeURLs(pr *PressRelease) (bool, error)
 	Stash(pr *PressRelease) (*pressReleaseEvent, error)
+	Quarantine(pr *PressRelease, problems []string) error
 	Replay(channel, lastEventId string) chan eventsource.Event
 }
 
@@ -44,6 +46,10 @@ func (store *TestStore) WhichAreNew(incoming []*PressRelease) []*PressRelease {
 	return incoming
 }
 
+func (store *TestStore) MergeURLs(pr *PressRelease) (bool, error) {
+	return false, nil
+}
+
 func (store *TestStore) Stash(pr *PressRelease) (*pressReleaseEvent, error) {
 	if store.briefMode {
 		fmt.Printf("%s \"%s\" %s\n", pr.PubDate, pr.Title, pr.Permalink)
@@ -58,6 +64,15 @@ func (store *TestStore) Stash(pr *PressRelease) (*pressReleaseEvent, error) {
 	return &pressReleaseEvent{pr, int(id)}, nil
 }
 
+func (store *TestStore) Quarantine(pr *PressRelease, problems []string) error {
+	fmt.Printf("QUARANTINED %s (%s)\n", pr.Permalink, strings.Join(problems, "; "))
+	if !store.briefMode {
+		fmt.Printf("%s\n %s\n\n%s\n", pr.Title, pr.PubDate, pr.Content)
+		fmt.Println("------------------------------")
+	}
+	return nil
+}
+
 func (store *TestStore) Replay(channel, lastEventId string) chan eventsource.Event {
 	panic("unsupported")
 	return nil
@@ -69,6 +84,11 @@ func (store *TestStore) Replay(channel, lastEventId string) chan eventsource.Eve
 // Can stash away press releases for multiple sources.
 type DBStore struct {
 	db *sql.DB
+
+	// last-event-ids recently used by clients (see prune.go)
+	cursors *cursorTracker
+	// is the full-text index available? (see search.go)
+	searchable bool
 }
 
 // pressReleaseEvent wraps up a PressRelease for use as a server-sent event.
@@ -95,6 +115,7 @@ func (ev *pressReleaseEvent) Data() string {
 
 func NewDBStore(dbfile string) *DBStore {
 	store := new(DBStore)
+	store.cursors = newCursorTracker()
 	//db, err := sql.Open("sqlite3", "file:"+dbfile+"?cache=shared&mode=rwc")
 	db, err := sql.Open("sqlite3", dbfile)
 	if err != nil {
@@ -105,6 +126,7 @@ func NewDBStore(dbfile string) *DBStore {
 	if err != nil {
 		panic(err)
 	}
+	store.initAutoVacuum()
 
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS press_release (
          id INTEGER PRIMARY KEY,
@@ -112,12 +134,25 @@ func NewDBStore(dbfile string) *DBStore {
          source TEXT NOT NULL,
          permalink TEXT NOT NULL,
          pubdate DATETIME NOT NULL,
-         content TEXT NOT NULL )`)
+         content TEXT NOT NULL,
+         scraped DATETIME,
+         fingerprint TEXT,
+         minhash TEXT,
+         dup_group INTEGER,
+         checked DATETIME )`)
 	if err != nil {
 		panic(err)
 	}
 
 	store.fixDates()
+	store.addScrapedColumn()
+	store.initURLs()
+	store.initSearch()
+	store.initHTTPCache()
+	store.initQuarantine()
+	store.initFingerprints()
+	store.initRevisions()
+	store.initRaw()
 
 	return store
 }
@@ -142,30 +177,188 @@ func (store *DBStore) fixDates() {
 	fmt.Printf("done.\n")
 }
 
-// returns a list of press releases with the ones already in the store culled out
+// hasColumn checks if a table has the named column
+func (store *DBStore) hasColumn(table, column string) bool {
+	rows, err := store.db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			panic(err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	return found
+}
+
+// addScrapedColumn upgrades older dbs which don't record when each press
+// release was scraped. Existing rows just use the pubdate.
+func (store *DBStore) addScrapedColumn() {
+	if store.hasColumn("press_release", "scraped") {
+		return
+	}
+
+	fmt.Printf("ADDING scraped column...")
+	_, err := store.db.Exec("ALTER TABLE press_release ADD COLUMN scraped DATETIME")
+	if err != nil {
+		panic(err)
+	}
+	_, err = store.db.Exec("UPDATE press_release SET scraped=pubdate WHERE scraped IS NULL")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("done.\n")
+}
+
+// initURLs sets up the table holding all the urls for each press release
+// (the permalink plus any aliases)
+func (store *DBStore) initURLs() {
+	var cnt int
+	err := store.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name='press_release_url'").Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	exists := cnt > 0
+
+	_, err = store.db.Exec(`CREATE TABLE IF NOT EXISTS press_release_url (
+         id INTEGER PRIMARY KEY,
+         press_release_id INTEGER NOT NULL,
+         url TEXT NOT NULL )`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = store.db.Exec(`CREATE INDEX IF NOT EXISTS press_release_url_url ON press_release_url(url)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = store.db.Exec(`CREATE INDEX IF NOT EXISTS press_release_url_pr ON press_release_url(press_release_id)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = store.db.Exec(`CREATE TRIGGER IF NOT EXISTS press_release_url_del AFTER DELETE ON press_release BEGIN
+           DELETE FROM press_release_url WHERE press_release_id=old.id;
+         END`)
+	if err != nil {
+		panic(err)
+	}
+
+	if !exists {
+		fmt.Printf("COPYING permalinks to press_release_url...")
+		_, err = store.db.Exec("INSERT INTO press_release_url (press_release_id,url) SELECT id,permalink FROM press_release")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("done.\n")
+	}
+}
+
+// returns a list of press releases with the ones already in the store culled out.
+// A press release is considered already seen if any of its urls are known.
 func (store *DBStore) WhichAreNew(incoming []*PressRelease) []*PressRelease {
 	var unseen []*PressRelease
-	// should really just use a single sql query ("WHERE permalink IN (...)" but hey.
+	seen := make(map[string]bool) // to catch dupes within incoming
+	// should really just use a single sql query ("WHERE url IN (...)" but hey.
 	for _, pr := range incoming {
-		var id int64
-		err := store.db.QueryRow("SELECT id FROM press_release WHERE permalink=$1 AND source=$2", pr.Permalink, pr.Source).Scan(&id)
-		switch err {
-		case nil:
-			// it's already in db
-		case sql.ErrNoRows:
+		urls := pr.AllURLs()
+		dupe := false
+		for _, u := range urls {
+			if seen[u] {
+				dupe = true
+				break
+			}
+			var id int64
+			err := store.db.QueryRow("SELECT p.id FROM press_release p JOIN press_release_url u ON u.press_release_id=p.id WHERE u.url=$1 AND p.source=$2", u, pr.Source).Scan(&id)
+			if err == nil {
+				// it's already in db
+				dupe = true
+				break
+			}
+			if err != sql.ErrNoRows {
+				panic(err)
+			}
+			// already quarantined (or discarded)?
+			qid, err := store.quarantined(u, pr.Source)
+			if err != nil {
+				panic(err)
+			}
+			if qid != -1 {
+				dupe = true
+				break
+			}
+		}
+		for _, u := range urls {
+			seen[u] = true
+		}
+		if !dupe {
 			// it's a new one
 			unseen = append(unseen, pr)
-		default:
-			panic(err)
 		}
 	}
 	return unseen
 }
 
+// MergeURLs checks if a press release is already in the store under any of
+// its urls. If so, any urls not already known are added to the stored
+// press release, and true is returned.
+func (store *DBStore) MergeURLs(pr *PressRelease) (bool, error) {
+	urls := pr.AllURLs()
+	var id int64 = -1
+	for _, u := range urls {
+		err := store.db.QueryRow("SELECT p.id FROM press_release p JOIN press_release_url u ON u.press_release_id=p.id WHERE u.url=$1 AND p.source=$2", u, pr.Source).Scan(&id)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+	if id == -1 {
+		return false, nil
+	}
+
+	for _, u := range urls {
+		_, err := store.db.Exec("INSERT INTO press_release_url (press_release_id,url) SELECT $1,$2 WHERE NOT EXISTS (SELECT 1 FROM press_release_url WHERE press_release_id=$1 AND url=$2)", id, u)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
 // Stash adds a press release into the store
 func (store *DBStore) Stash(pr *PressRelease) (*pressReleaseEvent, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	res, err := store.db.Exec("INSERT INTO press_release (title,source,permalink,pubdate,content) VALUES ($1,$2,$3,$4,$5)", pr.Title, pr.Source, pr.Permalink, pr.PubDate, pr.Content)
+	ev, err := stash(tx, pr)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// stash adds a press release into the store, as part of a transaction
+func stash(tx *sql.Tx, pr *PressRelease) (*pressReleaseEvent, error) {
+	pr.URLs = pr.AllURLs()
+
+	res, err := tx.Exec("INSERT INTO press_release (title,source,permalink,pubdate,content,scraped) VALUES ($1,$2,$3,$4,$5,$6)", pr.Title, pr.Source, pr.Permalink, pr.PubDate, pr.Content, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -173,16 +366,187 @@ func (store *DBStore) Stash(pr *PressRelease) (*pressReleaseEvent, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, u := range pr.URLs {
+		_, err = tx.Exec("INSERT INTO press_release_url (press_release_id,url) VALUES ($1,$2)", id, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	group, err := setFingerprint(tx, id, newFingerprint(pr))
+	if err != nil {
+		return nil, err
+	}
+	if err = putRaw(tx, id, pr.raw); err != nil {
+		return nil, err
+	}
+	pr.DupGroup = int(group)
 	return &pressReleaseEvent{pr, int(id)}, nil
 }
 
+// prFields are the columns needed by scanPressRelease
+const prFields = `press_release.id, press_release.title, press_release.source,
+  press_release.permalink, press_release.pubdate, press_release.content,
+  (SELECT group_concat(url, ' ') FROM press_release_url WHERE press_release_id=press_release.id),
+  press_release.dup_group`
+
+// scanPressRelease reads in a row of prFields (plus any extra columns)
+func scanPressRelease(rows *sql.Rows, extra ...interface{}) (*pressReleaseEvent, error) {
+	var id int
+	var urls sql.NullString
+	var group sql.NullInt64
+	pr := &PressRelease{Type: "press release"}
+	dest := append([]interface{}{&id, &pr.Title, &pr.Source, &pr.Permalink, &pr.PubDate, &pr.Content, &urls, &group}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	pr.DupGroup = int(group.Int64)
+	if urls.Valid {
+		pr.URLs = strings.Fields(urls.String)
+	}
+	pr.URLs = pr.AllURLs()
+	return &pressReleaseEvent{pr, id}, nil
+}
+
+// Fetch retrieves a single press release by id.
+// Returns nil if there's no such press release.
+func (store *DBStore) Fetch(id int) (*pressReleaseEvent, error) {
+	rows, err := store.db.Query("SELECT "+prFields+" FROM press_release WHERE id=$1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanPressRelease(rows)
+}
+
+// Recent returns the most recently scraped press releases for a source,
+// newest first.
+func (store *DBStore) Recent(source string, limit int) ([]*pressReleaseEvent, error) {
+	rows, err := store.db.Query("SELECT "+prFields+" FROM press_release WHERE source=$1 ORDER BY id DESC LIMIT $2", source, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*pressReleaseEvent{}
+	for rows.Next() {
+		ev, err := scanPressRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// ReleaseQuery holds the criteria for Query().
+// Zero values mean "don't care".
+type ReleaseQuery struct {
+	Source string
+	// Since and Until limit the publication dates
+	Since time.Time
+	Until time.Time
+	// ByScraped makes Since and Until apply to when the press releases
+	// were scraped instead
+	ByScraped bool
+	// After is a cursor - only ids greater than this are returned
+	After int
+	Limit int
+}
+
+// sqlArgs collects the args for a query built up on the fly, handing out
+// the numbered placeholders to use for them
+type sqlArgs []interface{}
+
+// add appends an arg, returning its placeholder ($1, $2...)
+func (args *sqlArgs) add(v interface{}) string {
+	*args = append(*args, v)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// sqlTime formats a time for comparing against datetimes in the db
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// Query returns the press releases matching q, in id order
+func (store *DBStore) Query(q *ReleaseQuery) ([]*pressReleaseEvent, error) {
+	var args sqlArgs
+	where := []string{"id>" + args.add(q.After)}
+	if q.Source != "" {
+		where = append(where, "source="+args.add(q.Source))
+	}
+	col := "pubdate"
+	if q.ByScraped {
+		col = "scraped"
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "julianday("+col+")>=julianday("+args.add(sqlTime(q.Since))+")")
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "julianday("+col+")<julianday("+args.add(sqlTime(q.Until))+")")
+	}
+	sqlStr := "SELECT " + prFields + " FROM press_release WHERE " + strings.Join(where, " AND ") + " ORDER BY id"
+	if q.Limit > 0 {
+		sqlStr += " LIMIT " + args.add(q.Limit)
+	}
+
+	rows, err := store.db.Query(sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*pressReleaseEvent{}
+	for rows.Next() {
+		ev, err := scanPressRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// SourceCounts returns the number of stored press releases for each source
+func (store *DBStore) SourceCounts() (map[string]int, error) {
+	rows, err := store.db.Query("SELECT source, COUNT(*) FROM press_release GROUP BY source")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]int)
+	for rows.Next() {
+		var source string
+		var cnt int
+		if err := rows.Scan(&source, &cnt); err != nil {
+			return nil, err
+		}
+		out[source] = cnt
+	}
+	return out, rows.Err()
+}
+
+// Size returns the size of the database, in bytes
+func (store *DBStore) Size() (float64, error) {
+	var pageCount, pageSize int64
+	if err := store.db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := store.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return float64(pageCount * pageSize), nil
+}
+
 // Replay to handle last-event-id catchups
 // note: channel contains the source (eg 'tesco'...)
 func (store *DBStore) Replay(channel, lastEventId string) (out chan eventsource.Event) {
 	var err error
 	var rows *sql.Rows
+	cursor := -1
 
-	fields := "id,title,source,permalink,pubdate,content"
+	fields := prFields
 	if lastEventId == "" {
 		// no last eventid, just replay everything
 		if rows, err = store.db.Query("SELECT "+fields+" FROM press_release WHERE source=$1", channel); err != nil {
@@ -197,21 +561,27 @@ func (store *DBStore) Replay(channel, lastEventId string) (out chan eventsource.
 		if rows, err = store.db.Query("SELECT "+fields+" FROM press_release WHERE id>$1 AND source=$2", id, channel); err != nil {
 			panic(err)
 		}
+		// hold off pruning anything this client might need
+		cursor = id
+		store.cursors.Touch(channel, cursor)
 	}
 
 	out = make(chan eventsource.Event)
 	go func() {
+		if cursor >= 0 {
+			// client has caught up now, but note it again in case it
+			// drops out before getting any more events
+			defer store.cursors.Touch(channel, cursor)
+		}
 		defer close(out)
 		defer rows.Close()
 		for rows.Next() {
-			var id int
-			var pr PressRelease
-			pr.Type = "press release"
-			if err := rows.Scan(&id, &pr.Title, &pr.Source, &pr.Permalink, &pr.PubDate, &pr.Content); err != nil {
+			ev, err := scanPressRelease(rows)
+			if err != nil {
 				panic(err)
 			}
 
-			out <- &pressReleaseEvent{&pr, id}
+			out <- ev
 		}
 	}()
 	return
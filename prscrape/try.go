@@ -0,0 +1,298 @@
+package prscrape
+
+// Selector development tool.
+//
+// Rather than editing the config, restarting and running in test mode,
+// selectors can be tried out directly against a page:
+//
+//   ukpr -try <url or file> [scraper] [name=selector ...] [dump]
+//
+// where the names are as in the "scrape" and "discover" sections of the
+// config file (title, content, cruft, pubdate, end_selector, ends and
+// link_selector - ends can be given more than once). If a scraper from
+// the config file is named, its selectors are used as a starting point.
+// "dump" prints out the whole document tree.
+//
+// Each selector is reported along with what it matched, and the page is
+// then scraped just as the real scraper would.
+
+import (
+	"code.google.com/p/cascadia"
+	"code.google.com/p/go.net/html"
+	"fmt"
+	"github.com/bcampbell/fuzzytime"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tryMaxTree is the biggest match to dump out in full
+const tryMaxTree = 40
+
+// tryMaxText is how much text (in characters) to show for each match
+const tryMaxText = 200
+
+// tryMain handles the -try commandline mode
+func tryMain(target string, args []string, configFile string, out io.Writer) error {
+	sc := &ScrapeConfig{}
+	dc := &DiscoverConfig{}
+	fetcher := DefaultFetcher
+	rules := DefaultValidation
+	dump := false
+	for _, arg := range args {
+		if arg == "dump" {
+			dump = true
+			continue
+		}
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 1 {
+			// start from an existing scraper
+			cfg, found, err := findScraperConfig(configFile, arg)
+			if err != nil {
+				return err
+			}
+			if found.Scrape != nil {
+				*sc = *found.Scrape
+			}
+			if found.Discover != nil {
+				*dc = *found.Discover
+			}
+			// the top-level settings first, as LoadConfig does
+			fetcher = found.Fetch.apply(cfg.Fetch.apply(DefaultFetcher))
+			if rules, err = cfg.Validate.apply(DefaultValidation); err != nil {
+				return err
+			}
+			if rules, err = found.Validate.apply(rules); err != nil {
+				return err
+			}
+			continue
+		}
+		name, sel := parts[0], parts[1]
+		switch name {
+		case "title":
+			sc.Title = sel
+		case "content":
+			sc.Content = sel
+		case "cruft":
+			sc.Cruft = sel
+		case "pubdate":
+			sc.PubDate = sel
+		case "end_selector":
+			sc.EndSelector = sel
+		case "ends":
+			sc.Ends = append(sc.Ends, sel)
+		case "link_selector":
+			dc.LinkSelector = sel
+		default:
+			return fmt.Errorf("unknown selector '%s'", name)
+		}
+	}
+
+	resp, err := tryFetch(fetcher, target)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(resp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s (%d bytes)\n", page.URL, len(resp.Body))
+	if page.Canonical != "" {
+		fmt.Fprintf(out, "canonical: %s\n", page.Canonical)
+	}
+	if dump {
+		fdumpTree(out, page.Root, 0)
+	}
+
+	for _, s := range []struct{ name, sel string }{
+		{"title", sc.Title},
+		{"pubdate", sc.PubDate},
+		{"content", sc.Content},
+		{"cruft", sc.Cruft},
+		{"end_selector", sc.EndSelector},
+		{"link_selector", dc.LinkSelector},
+	} {
+		if s.sel == "" {
+			continue
+		}
+		if err := tryReport(out, page.Root, s.name, s.sel); err != nil {
+			return err
+		}
+	}
+
+	if dc.LinkSelector != "" {
+		if err := tryLinks(out, page, dc); err != nil {
+			return err
+		}
+	}
+
+	if sc.Title == "" || sc.Content == "" {
+		fmt.Fprintf(out, "\n(need title and content selectors to scrape)\n")
+		return nil
+	}
+	return tryScrape(out, resp, sc, rules)
+}
+
+// findScraperConfig looks up a scraper in the config file (returning the
+// whole config too, for its top-level settings)
+func findScraperConfig(configFile, name string) (*Config, *ScraperConfig, error) {
+	if configFile == "" {
+		return nil, nil, fmt.Errorf("no config file to find '%s' in", name)
+	}
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sc := range cfg.Scrapers {
+		if sc.Name == name {
+			return cfg, sc, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no scraper '%s' in %s", name, configFile)
+}
+
+// tryFetch gets the page from the web, or from a local file
+func tryFetch(f *Fetcher, target string) (*fetchResult, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		return f.fetch(u)
+	}
+	body, err := ioutil.ReadFile(target)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	return &fetchResult{URL: u, StatusCode: 200, Body: body, Fetched: time.Now()}, nil
+}
+
+// tryReport describes what a selector matches
+func tryReport(out io.Writer, root *html.Node, name, selStr string) error {
+	sel, err := cascadia.Compile(selStr)
+	if err != nil {
+		return fmt.Errorf("bad %s selector: %s", name, err)
+	}
+	matches := sel.MatchAll(root)
+	fmt.Fprintf(out, "\n%s \"%s\": %d matches\n", name, selStr, len(matches))
+	if len(matches) == 0 {
+		fmt.Fprintf(out, "  (use \"dump\" to see the document tree)\n")
+	}
+	for i, n := range matches {
+		fmt.Fprintf(out, "%d. %s\n", i+1, NodePath(n))
+		txt := CompressSpace(RenderText(n))
+		if runes := []rune(txt); len(runes) > tryMaxText {
+			txt = string(runes[:tryMaxText]) + "..."
+		}
+		fmt.Fprintf(out, "   text: %s\n", strconv.Quote(txt))
+		if name == "pubdate" {
+			t, err := fuzzytime.Parse(GetTextContent(n))
+			if err != nil {
+				fmt.Fprintf(out, "   date: %s\n", err)
+			} else if t.IsZero() {
+				fmt.Fprintf(out, "   date: none found\n")
+			} else {
+				fmt.Fprintf(out, "   date: %s\n", t.Format(time.RFC3339))
+			}
+		}
+		if countNodes(n) <= tryMaxTree {
+			fdumpTree(out, n, 3)
+		}
+	}
+	return nil
+}
+
+func countNodes(n *html.Node) int {
+	cnt := 1
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		cnt += countNodes(child)
+	}
+	return cnt
+}
+
+// tryLinks shows the links discovery would pick up
+func tryLinks(out io.Writer, page *fetchedPage, dc *DiscoverConfig) error {
+	sel, err := cascadia.Compile(dc.LinkSelector)
+	if err != nil {
+		return err
+	}
+	all, err := getLinks(page.Root, page.URL, "", sel, true)
+	if err != nil {
+		return err
+	}
+	kept, err := getLinks(page.Root, page.URL, "", sel, dc.AllowHostChange)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nlinks: %d (%d to other sites)\n", len(kept), len(all)-len(kept))
+	for _, pr := range kept {
+		fmt.Fprintf(out, "  %s\n", pr.Permalink)
+	}
+	return nil
+}
+
+// tryScrape runs the page through a scraper built from the selectors
+func tryScrape(out io.Writer, resp *fetchResult, sc *ScrapeConfig, rules *ValidationRules) error {
+	scrapeFn, err := BuildGenericScrapeWithEnds("try", sc.Title, sc.Content, sc.Cruft, sc.PubDate, sc.EndSelector, sc.Ends)
+	if err != nil {
+		return err
+	}
+	// a fresh copy, as scraping alters the tree
+	page, err := parsePage(resp)
+	if err != nil {
+		return err
+	}
+
+	if len(sc.Ends) > 0 {
+		pats := make([]*regexp.Regexp, len(sc.Ends))
+		for i, end := range sc.Ends {
+			pats[i] = regexp.MustCompile(end) // (already checked by BuildGenericScrapeWithEnds)
+		}
+		sel := cascadia.MustCompile(sc.Content)
+		fmt.Fprintf(out, "\nends:\n")
+		cut := false
+		for _, n := range sel.MatchAll(page.Root) {
+			txt := RenderText(n)
+			if pos := FindEnd(txt, pats); pos >= 0 {
+				line := txt[pos:]
+				if i := strings.Index(line, "\n"); i >= 0 {
+					line = line[:i]
+				}
+				fmt.Fprintf(out, "  cut at %s\n", strconv.Quote(line))
+				cut = true
+				break
+			}
+		}
+		if !cut {
+			fmt.Fprintf(out, "  no matches\n")
+		}
+	}
+
+	pr := &PressRelease{Permalink: page.URL.String()}
+	if err := scrapePage(&Scraper{Name: "try", Scrape: scrapeFn}, pr, page); err != nil {
+		// (most likely a selector which matched nothing)
+		fmt.Fprintf(out, "\nscrape failed: %s\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "\n------------------------------\n")
+	fmt.Fprintf(out, "%s\n %s", pr.Title, pr.PubDate)
+	if pr.pubDateFudged {
+		fmt.Fprintf(out, " (guessed)")
+	}
+	fmt.Fprintf(out, "\n %s\n\n%s\n", pr.Permalink, pr.Content)
+	fmt.Fprintf(out, "------------------------------\n")
+	if problems := rules.Check(pr, time.Now()); len(problems) > 0 {
+		fmt.Fprintf(out, "would be quarantined: %s\n", strings.Join(problems, "; "))
+	}
+	return nil
+}
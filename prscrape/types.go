@@ -6,14 +6,44 @@ import (
 )
 
 // PressRelease is the data we're scraping and storing.
-// TODO: support multiple urls
+// A press release can often be reached by more than one url (rss link,
+// canonical url, mirror sites etc). URLs holds all of them, including the
+// Permalink.
+// Copies of the same press release (eg from different sources) share the
+// same DupGroup (see fingerprint.go).
 type PressRelease struct {
 	Title     string    `json:"title"`
 	Source    string    `json:"source"`
 	Permalink string    `json:"permalink"`
+	URLs      []string  `json:"urls"`
 	PubDate   time.Time `json:"published"`
 	Content   string    `json:"text"`
 	Type      string    `json:"type"`
+	DupGroup  int       `json:"dup_group,omitempty"`
+
+	// pubDateFudged is set if PubDate is just a guess
+	pubDateFudged bool
+	// raw is the page it was scraped from (see raw.go)
+	raw *RawPage
+}
+
+// AllURLs returns the permalink plus any other known urls (without dupes)
+func (pr *PressRelease) AllURLs() []string {
+	out := []string{}
+	seen := make(map[string]bool)
+	for _, u := range append([]string{pr.Permalink}, pr.URLs...) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// AddURL adds an alternative url for the press release
+func (pr *PressRelease) AddURL(u string) {
+	pr.URLs = append(pr.URLs, u)
+	pr.URLs = pr.AllURLs()
 }
 
 type ConfigureFunc func(historical bool) []*Scraper
@@ -26,6 +56,8 @@ type ConfigureFunc func(historical bool) []*Scraper
 // data is available (eg some rss feeds have everything required).
 // For incomplete PressReleases, the framework will fetch the HTML from
 // the Permalink URL, and invoke Scrape() to complete the data.
+// The generic discover functions return errNotModified if nothing has
+// changed since the last run.
 type DiscoverFunc func() ([]*PressRelease, error)
 
 // ScrapeFunc is for scraping a single press release from html
@@ -36,4 +68,18 @@ type Scraper struct {
 	Name     string
 	Discover DiscoverFunc
 	Scrape   ScrapeFunc
+	// Interval is how often to run the scraper (0 = use the default)
+	Interval time.Duration
+	// Retention is how long to keep press releases for
+	// (0 = use the default, <0 = keep forever)
+	Retention time.Duration
+	// Recheck is how long after storing press releases to keep checking
+	// them for changes (0 = use the default, <0 = never)
+	Recheck time.Duration
+	// Fetcher is used to fetch press release pages for Scrape
+	// (nil = use DefaultFetcher)
+	Fetcher *Fetcher
+	// Validation is used to check scraped press releases
+	// (nil = use DefaultValidation)
+	Validation *ValidationRules
 }
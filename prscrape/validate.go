@@ -0,0 +1,124 @@
+package prscrape
+
+// Sanity checking of scraped press releases.
+//
+// Press releases which fail validation are put into quarantine (see
+// quarantine.go) rather than being stored and sent out to clients.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ValidationRules describe what a press release needs to be acceptable
+type ValidationRules struct {
+	RequireTitle   bool
+	RequireContent bool
+	// RequirePubDate rejects press releases without a real publication
+	// date (ie if it had to be fudged)
+	RequirePubDate   bool
+	MinContentLength int
+	// NotBefore rejects publication dates earlier than this (zero = no limit)
+	NotBefore time.Time
+	// MaxFuture rejects publication dates more than this far in the future
+	// (0 = no limit)
+	MaxFuture time.Duration
+}
+
+// DefaultValidation is used for scrapers which don't specify their own rules
+var DefaultValidation = &ValidationRules{
+	RequireTitle:   true,
+	RequireContent: true,
+	RequirePubDate: true,
+	NotBefore:      time.Date(1995, 1, 1, 0, 0, 0, 0, time.UTC),
+	MaxFuture:      24 * time.Hour,
+}
+
+const problemNoPubDate = "missing pubdate"
+
+// Check returns a list of the problems with a press release (empty if ok)
+func (rules *ValidationRules) Check(pr *PressRelease, now time.Time) []string {
+	problems := []string{}
+	if rules.RequireTitle && strings.TrimSpace(pr.Title) == "" {
+		problems = append(problems, "missing title")
+	}
+	content := strings.TrimSpace(pr.Content)
+	if rules.RequireContent && content == "" {
+		problems = append(problems, "missing content")
+	} else if content != "" && len(content) < rules.MinContentLength {
+		problems = append(problems, fmt.Sprintf("content too short (%d chars)", len(content)))
+	}
+
+	if pr.PubDate.IsZero() || pr.pubDateFudged {
+		if rules.RequirePubDate {
+			problems = append(problems, problemNoPubDate)
+		}
+	} else {
+		if !rules.NotBefore.IsZero() && pr.PubDate.Before(rules.NotBefore) {
+			problems = append(problems, fmt.Sprintf("pubdate too early (%s)", pr.PubDate.Format("2006-01-02")))
+		}
+		if rules.MaxFuture > 0 && pr.PubDate.After(now.Add(rules.MaxFuture)) {
+			problems = append(problems, fmt.Sprintf("pubdate in the future (%s)", pr.PubDate.Format("2006-01-02")))
+		}
+	}
+	return problems
+}
+
+// validationFor returns the rules to use for a scraper
+func validationFor(scraper *Scraper) *ValidationRules {
+	if scraper != nil && scraper.Validation != nil {
+		return scraper.Validation
+	}
+	return DefaultValidation
+}
+
+// ValidateConfig holds validation rules in the config file. Anything left
+// unset keeps its existing value.
+type ValidateConfig struct {
+	// Require lists the fields which must be present, out of "title",
+	// "content" and "pubdate"
+	Require          []string `json:"require,omitempty"`
+	MinContentLength int      `json:"min_content_length,omitempty"`
+	// NotBefore is the earliest acceptable pubdate (YYYY-MM-DD)
+	NotBefore string `json:"not_before,omitempty"`
+	// MaxFutureHours is how far in the future pubdates can be (-1 = no limit)
+	MaxFutureHours int `json:"max_future_hours,omitempty"`
+}
+
+// apply returns new rules, based on base but with the config applied
+func (vc *ValidateConfig) apply(base *ValidationRules) (*ValidationRules, error) {
+	if vc == nil {
+		return base, nil
+	}
+	rules := *base
+	if vc.Require != nil {
+		rules.RequireTitle, rules.RequireContent, rules.RequirePubDate = false, false, false
+		for _, field := range vc.Require {
+			switch field {
+			case "title":
+				rules.RequireTitle = true
+			case "content":
+				rules.RequireContent = true
+			case "pubdate":
+				rules.RequirePubDate = true
+			default:
+				return nil, fmt.Errorf("can't require unknown field '%s'", field)
+			}
+		}
+	}
+	if vc.MinContentLength > 0 {
+		rules.MinContentLength = vc.MinContentLength
+	}
+	if vc.NotBefore != "" {
+		t, err := time.Parse("2006-01-02", vc.NotBefore)
+		if err != nil {
+			return nil, fmt.Errorf("bad not_before: %s", err)
+		}
+		rules.NotBefore = t
+	}
+	if vc.MaxFutureHours != 0 {
+		rules.MaxFuture = time.Duration(vc.MaxFutureHours) * time.Hour
+	}
+	return &rules, nil
+}